@@ -0,0 +1,53 @@
+package gcors
+
+import "github.com/gin-gonic/gin"
+
+// authorizedWriter adds the CORS headers of an actual request right before the response is
+// written, or once the handlers return when they wrote nothing, and only when the auth
+// middleware flagged the request, see Config.AuthorizedKey.
+type authorizedWriter struct {
+	gin.ResponseWriter
+	c      *gin.Context
+	cors   *gCors
+	origin string
+	done   bool
+}
+
+func (w *authorizedWriter) addHeaders() {
+	if w.done {
+		return
+	}
+	w.done = true
+	if !w.c.GetBool(w.cors.authorizedKey) {
+		return
+	}
+	header := w.ResponseWriter.Header()
+	for key, value := range w.cors.normalHeaders {
+		header[key] = value
+	}
+	if !w.cors.allowAllOrigins {
+		header.Set("Access-Control-Allow-Origin", w.origin)
+	} else if w.cors.reflectCredentialed {
+		w.cors.credentialFallback(w.c, w.origin)
+	}
+}
+
+func (w *authorizedWriter) WriteHeader(code int) {
+	w.addHeaders()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *authorizedWriter) WriteHeaderNow() {
+	w.addHeaders()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *authorizedWriter) Write(data []byte) (int, error) {
+	w.addHeaders()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *authorizedWriter) WriteString(s string) (int, error) {
+	w.addHeaders()
+	return w.ResponseWriter.WriteString(s)
+}
@@ -2,7 +2,13 @@ package gcors
 
 import (
 	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,8 +21,37 @@ type gCors struct {
 	allowOrigins               []string
 	normalHeaders              http.Header
 	preflightHeaders           http.Header
-	wildcardOrigins            [][]string
+	wildcardOrigins            []*regexp.Regexp
+	originRegexes              []*regexp.Regexp
 	optionsResponseStatusCode  int
+	optionsResponseBody        string
+	debugRejectHeaders         bool
+	enforceMethods             map[string]bool
+	unenforcedHeaders          []string
+	maxAgeByOrigin             map[string]string
+	allowDuplicateOrigins      bool
+	authorizedKey              string
+	originHeaders              map[string]originHeaders
+	reflectCredentialed        bool
+	preflightCache             sync.Map // origin -> http.Header
+	preflightCached            atomic.Int64
+	preflightCacheSize         int64
+	allowHeaders               map[string]bool
+	negotiateHeaders           bool
+	rejectDisallowedHeaders    bool
+	onOriginDenied             func(c *gin.Context, origin string)
+	allowPrivateNetwork        bool
+}
+
+// preflightCacheSize bounds the number of origins whose preflight headers are cached, so that
+// a permissive AllowOriginFunc cannot make the cache grow without limit.
+const preflightCacheSize = 1024
+
+// originHeaders are the complete response headers of one listed origin, built at startup so
+// the request path only copies them.
+type originHeaders struct {
+	normal    http.Header
+	preflight http.Header
 }
 
 var (
@@ -50,67 +85,351 @@ func newCors(config Config) *gCors {
 		}
 	}
 
+	if config.ReflectCredentialedOrigin {
+		// credentials are only allowed along with a reflected origin, see credentialFallback
+		config.AllowCredentials = false
+	}
+
+	config.AllowHeaders = canonicalHeaders(config.AllowHeaders)
+	config.ExposeHeaders = canonicalHeaders(config.ExposeHeaders)
+
 	if config.OptionsResponseStatusCode == 0 {
 		config.OptionsResponseStatusCode = http.StatusNoContent
+		if config.OptionsResponseBody != "" {
+			config.OptionsResponseStatusCode = http.StatusOK
+		}
 	}
 
-	return &gCors{
+	cors := &gCors{
 		allowOriginFunc:            config.AllowOriginFunc,
 		allowOriginWithContextFunc: config.AllowOriginWithContextFunc,
 		allowAllOrigins:            config.AllowAllOrigins,
 		allowCredentials:           config.AllowCredentials,
-		allowOrigins:               normalize(config.AllowOrigins),
+		allowOrigins:               convert(normalize(config.AllowOrigins), canonicalOrigin),
 		normalHeaders:              generateNormalHeaders(config),
 		preflightHeaders:           generatePreflightHeaders(config),
-		wildcardOrigins:            config.parseWildcardRules(),
+		wildcardOrigins:            compileWildcardRules(config.parseWildcardRules()),
+		originRegexes:              compileOriginRegexes(config.AllowOriginRegexes),
 		optionsResponseStatusCode:  config.OptionsResponseStatusCode,
+		optionsResponseBody:        config.OptionsResponseBody,
+		debugRejectHeaders:         config.DebugRejectHeaders,
+		enforceMethods:             enforcedMethods(config.EnforceMethods),
+		unenforcedHeaders:          unenforcedHeaders(config.AllowHeaders, config.EnforceHeaders),
+		maxAgeByOrigin:             maxAgeByOrigin(config.MaxAgeByOrigin),
+		allowDuplicateOrigins:      config.AllowDuplicateOrigins,
+		authorizedKey:              config.AuthorizedKey,
+		reflectCredentialed:        config.ReflectCredentialedOrigin,
+		preflightCacheSize:         preflightCacheSize,
+		allowHeaders:               headerSet(config.AllowHeaders),
+		negotiateHeaders:           config.NegotiateHeaders,
+		rejectDisallowedHeaders:    config.RejectDisallowedHeaders,
+		onOriginDenied:             config.OnOriginDenied,
+		allowPrivateNetwork:        config.AllowPrivateNetwork,
+	}
+	cors.originHeaders = cors.precomputeOriginHeaders()
+	return cors
+}
+
+// precomputeOriginHeaders builds the headers of every origin of AllowOrigins, keyed by the
+// exact Origin value they answer. Origins accepted by wildcards or functions, or sent in a
+// non-normalized form, are still built per request.
+func (gCors *gCors) precomputeOriginHeaders() map[string]originHeaders {
+	if gCors.allowAllOrigins || len(gCors.allowOrigins) == 0 {
+		return nil
 	}
+	out := make(map[string]originHeaders, len(gCors.allowOrigins))
+	for _, origin := range gCors.allowOrigins {
+		headers := originHeaders{
+			normal:    cloneHeaders(gCors.normalHeaders),
+			preflight: cloneHeaders(gCors.preflightHeaders),
+		}
+		if maxAge, ok := gCors.maxAgeByOrigin[origin]; ok {
+			headers.preflight.Set("Access-Control-Max-Age", maxAge)
+		}
+		headers.normal.Set("Access-Control-Allow-Origin", origin)
+		headers.preflight.Set("Access-Control-Allow-Origin", origin)
+		out[origin] = headers
+	}
+	return out
+}
+
+// cloneHeaders copies header with full-capacity slices, so that a later Add on a response
+// allocates instead of writing into the shared backing array.
+func cloneHeaders(header http.Header) http.Header {
+	out := make(http.Header, len(header)+1)
+	for key, values := range header {
+		out[key] = values[:len(values):len(values)]
+	}
+	return out
+}
+
+// copyHeaders installs the precomputed headers on the response.
+func copyHeaders(c *gin.Context, headers http.Header) {
+	header := c.Writer.Header()
+	for key, value := range headers {
+		header[key] = value
+	}
+}
+
+// maxAgeByOrigin precomputes the Access-Control-Max-Age values keyed by normalized origin.
+func maxAgeByOrigin(values map[string]time.Duration) map[string]string {
+	if len(values) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(values))
+	for origin, maxAge := range values {
+		origin = canonicalOrigin(strings.ToLower(strings.TrimSpace(origin)))
+		out[origin] = strconv.FormatInt(int64(maxAge/time.Second), 10)
+	}
+	return out
+}
+
+func enforcedMethods(methods []string) map[string]bool {
+	if len(methods) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(methods))
+	for _, method := range convert(normalize(methods), strings.ToUpper) {
+		set[method] = true
+	}
+	return set
+}
+
+func headerSet(headers []string) map[string]bool {
+	set := make(map[string]bool, len(headers))
+	for _, header := range headers {
+		set[header] = true
+	}
+	return set
+}
+
+// unenforcedHeaders returns the allowed headers actual requests must not carry.
+func unenforcedHeaders(allowHeaders, enforceHeaders []string) []string {
+	if len(enforceHeaders) == 0 {
+		return nil
+	}
+	enforced := make(map[string]bool, len(enforceHeaders))
+	for _, header := range canonicalHeaders(enforceHeaders) {
+		enforced[header] = true
+	}
+	var out []string
+	for _, header := range allowHeaders {
+		if !enforced[header] {
+			out = append(out, header)
+		}
+	}
+	return out
 }
 
 func (gCors *gCors) applyCors(c *gin.Context) {
+	if gCors.multipleOrigins(c) {
+		gCors.rejectWith(c, "multiple-origins")
+		return
+	}
+	origin, ok := corsOrigin(c)
+	if !ok {
+		return
+	}
+
+	if !gCors.isOriginValid(c, origin) {
+		gCors.reject(c, origin)
+		return
+	}
+
+	gCors.allow(c, origin)
+}
+
+// corsOrigin returns the Origin header of a cross-origin request.
+func corsOrigin(c *gin.Context) (string, bool) {
 	origin := c.Request.Header.Get("Origin")
 	if len(origin) == 0 {
 		// request is not a CORS request
-		return
+		return "", false
 	}
 	host := c.Request.Host
 
 	if origin == "http://"+host || origin == "https://"+host {
 		// request is not a CORS request but have origin header.
 		// for example, use fetch api
-		return
+		return "", false
+	}
+	return origin, true
+}
+
+// multipleOrigins detects requests smuggling several origins, of which Header.Get would only
+// validate the first.
+func (gCors *gCors) multipleOrigins(c *gin.Context) bool {
+	values := c.Request.Header.Values("Origin")
+	for _, value := range values {
+		if strings.ContainsAny(strings.TrimSpace(value), " ,") {
+			return true
+		}
+		if value != values[0] {
+			return true
+		}
 	}
+	return len(values) > 1 && !gCors.allowDuplicateOrigins
+}
 
-	if !gCors.isOriginValid(c, origin) {
-		c.AbortWithStatus(http.StatusForbidden)
+// reject answers a request whose origin is not allowed, letting OnOriginDenied log it or write
+// its own response first.
+func (gCors *gCors) reject(c *gin.Context, origin string) {
+	if gCors.onOriginDenied == nil {
+		gCors.rejectWith(c, gCors.rejectReason())
 		return
 	}
+	if gCors.debugRejectHeaders {
+		c.Header("X-CORS-Rejected-Reason", gCors.rejectReason())
+	}
+	gCors.onOriginDenied(c, origin)
+	if c.Writer.Written() {
+		c.Abort()
+		return
+	}
+	c.AbortWithStatus(http.StatusForbidden)
+}
+
+func (gCors *gCors) rejectWith(c *gin.Context, reason string) {
+	if gCors.debugRejectHeaders {
+		c.Header("X-CORS-Rejected-Reason", reason)
+	}
+	c.AbortWithStatus(http.StatusForbidden)
+}
 
+func (gCors *gCors) allow(c *gin.Context, origin string) {
 	if c.Request.Method == "OPTIONS" {
-		gCors.handlePreflight(c)
-		defer c.AbortWithStatus(gCors.optionsResponseStatusCode)
-	} else {
-		gCors.handleNormal(c)
+		if gCors.rejectDisallowedHeaders && gCors.disallowedHeader(c) {
+			gCors.rejectWith(c, "header-not-allowed")
+			return
+		}
+		gCors.setPreflightHeaders(c, origin)
+		if gCors.negotiateHeaders {
+			gCors.negotiate(c)
+		}
+		if gCors.allowPrivateNetwork && strings.EqualFold(c.Request.Header.Get("Access-Control-Request-Private-Network"), "true") {
+			c.Header("Access-Control-Allow-Private-Network", "true")
+		}
+		gCors.abortPreflight(c)
+		return
 	}
 
+	if reason := gCors.enforceReason(c); reason != "" {
+		gCors.rejectWith(c, reason)
+		return
+	}
+	if gCors.authorizedKey != "" {
+		// authorized or not, the response depends on the origin
+		if header := c.Writer.Header(); !slices.Contains(header.Values("Vary"), "Origin") {
+			header.Add("Vary", "Origin")
+		}
+		writer := &authorizedWriter{ResponseWriter: c.Writer, c: c, cors: gCors, origin: origin}
+		c.Writer = writer
+		c.Next()
+		// a handler writing nothing leaves the status to gin, which flushes its own writer
+		// and never reaches ours
+		writer.addHeaders()
+		return
+	}
+	if precomputed, ok := gCors.originHeaders[origin]; ok {
+		copyHeaders(c, precomputed.normal)
+		return
+	}
+	gCors.handleNormal(c)
 	if !gCors.allowAllOrigins {
 		c.Header("Access-Control-Allow-Origin", origin)
+	} else if gCors.reflectCredentialed {
+		gCors.credentialFallback(c, origin)
 	}
 }
 
-func (gCors *gCors) validateWildcardOrigin(origin string) bool {
-	for _, w := range gCors.wildcardOrigins {
-		if w[0] == "*" && strings.HasSuffix(origin, w[1]) {
+// setPreflightHeaders installs the precomputed headers of a listed origin, the cached ones of
+// another allowed origin or, with all origins allowed, the shared ones.
+func (gCors *gCors) setPreflightHeaders(c *gin.Context, origin string) {
+	if precomputed, ok := gCors.originHeaders[origin]; ok {
+		copyHeaders(c, precomputed.preflight)
+		return
+	}
+	if !gCors.allowAllOrigins {
+		copyHeaders(c, gCors.cachedPreflight(origin))
+		return
+	}
+	gCors.handlePreflight(c, origin)
+	if gCors.reflectCredentialed {
+		gCors.credentialFallback(c, origin)
+	}
+}
+
+// requestedHeaders returns the canonical names listed in Access-Control-Request-Headers.
+func requestedHeaders(c *gin.Context) []string {
+	var names []string
+	for _, value := range c.Request.Header.Values("Access-Control-Request-Headers") {
+		names = append(names, strings.Split(value, ",")...)
+	}
+	return canonicalHeaders(names)
+}
+
+// disallowedHeader reports whether the preflight requests a header missing from AllowHeaders.
+func (gCors *gCors) disallowedHeader(c *gin.Context) bool {
+	for _, name := range requestedHeaders(c) {
+		if !gCors.allowHeaders[name] {
 			return true
 		}
-		if w[1] == "*" && strings.HasPrefix(origin, w[0]) {
-			return true
+	}
+	return false
+}
+
+// negotiate narrows Access-Control-Allow-Headers down to the requested headers that are allowed,
+// in the order they were requested. The header is dropped when none of them is.
+func (gCors *gCors) negotiate(c *gin.Context) {
+	var allowed []string
+	for _, name := range requestedHeaders(c) {
+		if gCors.allowHeaders[name] {
+			allowed = append(allowed, name)
 		}
-		if strings.HasPrefix(origin, w[0]) && strings.HasSuffix(origin, w[1]) {
+	}
+	header := c.Writer.Header()
+	if len(allowed) == 0 {
+		header.Del("Access-Control-Allow-Headers")
+	} else {
+		header.Set("Access-Control-Allow-Headers", strings.Join(allowed, ","))
+	}
+	if !slices.Contains(header.Values("Vary"), "Access-Control-Request-Headers") {
+		header.Add("Vary", "Access-Control-Request-Headers")
+	}
+}
+
+// credentialFallback replaces the "*" of ReflectCredentialedOrigin by the origin on preflights
+// and credentialed requests.
+func (gCors *gCors) credentialFallback(c *gin.Context, origin string) {
+	header := c.Writer.Header()
+	if c.Request.Method == "OPTIONS" {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+		header.Set("Vary", "Origin")
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		return
+	}
+	if hasCredentials(c.Request) {
+		header.Set("Access-Control-Allow-Origin", origin)
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	header.Set("Vary", "Origin")
+	header.Add("Vary", "Cookie")
+	header.Add("Vary", "Authorization")
+}
+
+// hasCredentials reports whether a request carries cookies or HTTP authentication.
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Cookie") != "" || r.Header.Get("Authorization") != ""
+}
+
+func (gCors *gCors) validateWildcardOrigin(origin string) bool {
+	for _, re := range gCors.wildcardOrigins {
+		if re.MatchString(origin) {
 			return true
 		}
 	}
-
 	return false
 }
 
@@ -122,29 +441,97 @@ func (gCors *gCors) isOriginValid(c *gin.Context, origin string) bool {
 	return valid
 }
 
+// rejectReason explains a failed isOriginValid for DebugRejectHeaders.
+func (gCors *gCors) rejectReason() string {
+	if gCors.allowOriginFunc != nil || gCors.allowOriginWithContextFunc != nil {
+		return "blocked"
+	}
+	if len(gCors.wildcardOrigins) > 0 {
+		return "wildcard-mismatch"
+	}
+	if len(gCors.originRegexes) > 0 {
+		return "regex-mismatch"
+	}
+	return "origin-not-allowed"
+}
+
+// enforceReason checks an actual request against EnforceMethods and EnforceHeaders.
+func (gCors *gCors) enforceReason(c *gin.Context) string {
+	if gCors.enforceMethods != nil && !gCors.enforceMethods[c.Request.Method] {
+		return "method-not-enforced"
+	}
+	for _, header := range gCors.unenforcedHeaders {
+		if _, ok := c.Request.Header[header]; ok {
+			return "header-not-enforced"
+		}
+	}
+	return ""
+}
+
 func (gCors *gCors) validateOrigin(origin string) bool {
 	if gCors.allowAllOrigins {
 		return true
 	}
+	normalized := canonicalOrigin(origin)
 	for _, value := range gCors.allowOrigins {
-		if value == origin {
+		if value == normalized {
 			return true
 		}
 	}
 	if len(gCors.wildcardOrigins) > 0 && gCors.validateWildcardOrigin(origin) {
 		return true
 	}
+	for _, re := range gCors.originRegexes {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
 	if gCors.allowOriginFunc != nil {
 		return gCors.allowOriginFunc(origin)
 	}
 	return false
 }
 
-func (gCors *gCors) handlePreflight(c *gin.Context) {
+func (gCors *gCors) handlePreflight(c *gin.Context, origin string) {
 	header := c.Writer.Header()
 	for key, value := range gCors.preflightHeaders {
 		header[key] = value
 	}
+	if maxAge, ok := gCors.maxAgeByOrigin[canonicalOrigin(strings.ToLower(origin))]; ok {
+		header.Set("Access-Control-Max-Age", maxAge)
+	}
+}
+
+// cachedPreflight returns the preflight headers of an origin accepted by a wildcard or a
+// function, built on its first preflight and reused afterwards. The origin is still validated
+// on every request, the config being immutable nothing is ever invalidated.
+func (gCors *gCors) cachedPreflight(origin string) http.Header {
+	if headers, ok := gCors.preflightCache.Load(origin); ok {
+		return headers.(http.Header)
+	}
+	headers := cloneHeaders(gCors.preflightHeaders)
+	if maxAge, ok := gCors.maxAgeByOrigin[canonicalOrigin(strings.ToLower(origin))]; ok {
+		headers.Set("Access-Control-Max-Age", maxAge)
+	}
+	headers.Set("Access-Control-Allow-Origin", origin)
+	if gCors.preflightCached.Add(1) > gCors.preflightCacheSize {
+		return headers
+	}
+	cached, _ := gCors.preflightCache.LoadOrStore(origin, headers)
+	return cached.(http.Header)
+}
+
+func (gCors *gCors) abortPreflight(c *gin.Context) {
+	if gCors.optionsResponseBody == "" {
+		c.AbortWithStatus(gCors.optionsResponseStatusCode)
+		return
+	}
+	c.Abort()
+	contentType := c.Writer.Header().Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	c.Data(gCors.optionsResponseStatusCode, contentType, []byte(gCors.optionsResponseBody))
 }
 
 func (gCors *gCors) handleNormal(c *gin.Context) {
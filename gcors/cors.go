@@ -3,6 +3,11 @@ package gcors
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -18,6 +23,12 @@ type Config struct {
 	// Default value is []
 	AllowOrigins []string
 
+	// AllowOriginRegexes are regular expressions matched against the whole Origin header, e.g.
+	// `^https://.*\.example\.(com|org)$`. Anchor them, an unanchored expression matches any
+	// origin containing it. Origins are checked against exact AllowOrigins entries, then
+	// wildcards, then these expressions, then AllowOriginFunc. Default value is []
+	AllowOriginRegexes []string
+
 	// AllowOriginFunc is a custom function to validate the origin. It takes the origin
 	// as an argument and returns true if allowed or false otherwise. If this option is
 	// set, the content of AllowOrigins is ignored.
@@ -33,13 +44,37 @@ type Config struct {
 	// cross-domain requests. Default value is simple methods (GET, POST, PUT, PATCH, DELETE, HEAD, and OPTIONS)
 	AllowMethods []string
 
-	// AllowPrivateNetwork indicates whether the response should include allow private network header
+	// EnforceMethods, when set, is the stricter list of methods actual (non-preflight) requests
+	// may use, while AllowMethods is still what preflight responses advertise. Requests with
+	// another method are rejected with 403, which allows tightening a policy without breaking
+	// tooling relying on the preflight answer. Default value is [] (no enforcement)
+	EnforceMethods []string
+
+	// EnforceHeaders, when set, is the stricter list of AllowHeaders actual requests may carry.
+	// A request sending a header advertised in AllowHeaders but missing from EnforceHeaders is
+	// rejected with 403; headers not listed in AllowHeaders are not checked. Default value is []
+	EnforceHeaders []string
+
+	// AllowPrivateNetwork answers "Access-Control-Allow-Private-Network: true" to the preflights
+	// of Private Network Access, which carry "Access-Control-Request-Private-Network: true" when
+	// a public page calls a private or local address. Other preflights do not get the header
 	AllowPrivateNetwork bool
 
 	// AllowHeaders is list of non simple headers the client is allowed to use with
 	// cross-domain requests.
 	AllowHeaders []string
 
+	// NegotiateHeaders answers preflights with the intersection of Access-Control-Request-Headers
+	// and AllowHeaders, in the requested order, instead of the whole AllowHeaders list. The
+	// browser then still fails a request using a header left out, but the policy is not
+	// disclosed. Access-Control-Allow-Headers is omitted when nothing intersects, and responses
+	// vary on Access-Control-Request-Headers. Default value is false
+	NegotiateHeaders bool
+
+	// RejectDisallowedHeaders rejects with 403 the preflights requesting a header missing from
+	// AllowHeaders, instead of answering and letting the browser fail. Default value is false
+	RejectDisallowedHeaders bool
+
 	// AllowCredentials indicates whether the request can include user credentials like
 	// cookies, HTTP authentication or client side SSL certificates.
 	AllowCredentials bool
@@ -49,10 +84,18 @@ type Config struct {
 	ExposeHeaders []string
 
 	// MaxAge indicates how long (with second-precision) the results of a preflight request
-	// can be cached
+	// can be cached. It is sent as whole seconds in Access-Control-Max-Age; below one second
+	// the header is omitted and browsers apply their own default
 	MaxAge time.Duration
 
+	// MaxAgeByOrigin overrides MaxAge for the listed origins, e.g. to let trusted partners
+	// cache preflight results longer. A zero value sends "Access-Control-Max-Age: 0", which
+	// disables caching for that origin. Values must not be negative
+	MaxAgeByOrigin map[string]time.Duration
+
 	// Allows to add origins like http://some-domain/*, https://api.* or http://some.*.subdomain.com
+	// Matches are anchored at both ends: a leading or inner * only covers host characters
+	// (and the scheme for a leading one), a trailing * anything but spaces and commas.
 	AllowWildcard bool
 
 	// Allows usage of popular browser extensions schemas
@@ -61,6 +104,10 @@ type Config struct {
 	// Allows to add custom schema like tauri://
 	CustomSchemas []string
 
+	// AllowedSchemes are extra origin schemes accepted in AllowOrigins, e.g. "capacitor" or
+	// "chrome-extension://". Entries are lower-cased and completed with "://"
+	AllowedSchemes []string
+
 	// Allows usage of WebSocket protocol
 	AllowWebSockets bool
 
@@ -69,6 +116,49 @@ type Config struct {
 
 	// Allows to pass custom OPTIONS response status code for old browsers / clients
 	OptionsResponseStatusCode int
+
+	// OptionsResponseBody is written as the body of preflight responses. When it is set
+	// and OptionsResponseStatusCode is not, the status defaults to 200 since a 204
+	// response cannot carry a body. Default value is empty
+	OptionsResponseBody string
+
+	// OptionsResponseHeaders are extra headers added to preflight responses
+	OptionsResponseHeaders http.Header
+
+	// AllowDuplicateOrigins accepts requests repeating the same Origin header value several
+	// times. Requests with several different Origin values, or one value listing several
+	// origins, are always rejected with 403 since only the first one would be validated.
+	// Default value is false: any repeated Origin header is rejected
+	AllowDuplicateOrigins bool
+
+	// AuthorizedKey, when set, withholds the CORS headers of actual requests from callers the
+	// auth middleware did not authenticate, so the API is not advertised to them. The headers are
+	// added when the response is written, and only if c.GetBool(AuthorizedKey) is true by then.
+	// gcors must be registered before the auth middleware, which sets the key with c.Set once the
+	// caller is authenticated. Preflights carry no credentials and are still answered normally.
+	// Default value is "" (headers always sent)
+	AuthorizedKey string
+
+	// OnOriginDenied is called with the origin of a request rejected because its origin is not
+	// allowed, right before the 403 is written, e.g. to log it or count it. It may write its
+	// own response instead, e.g. with c.AbortWithStatusJSON, the request is aborted either way.
+	// Default value is nil (plain 403)
+	OnOriginDenied func(c *gin.Context, origin string)
+
+	// DebugRejectHeaders adds an X-CORS-Rejected-Reason header to 403 responses for rejected
+	// origins. It reveals policy details, keep it off in production. Default value is false
+	DebugRejectHeaders bool
+
+	// ReflectCredentialedOrigin, with all origins allowed, keeps answering "*" to requests
+	// without credentials but reflects the origin with "Access-Control-Allow-Credentials: true"
+	// to requests carrying a Cookie or Authorization header, which browsers refuse to match
+	// against "*". Preflights cannot tell whether the actual request will be credentialed and
+	// always get the reflected origin. Responses then vary on Origin, Cookie and Authorization,
+	// and the Vary header says so, which makes shared caches key "*" responses per credential.
+	// AllowCredentials is ignored in this mode. Beware that it grants every origin credentialed
+	// access, the same exposure as Dev, and must not be used in production unless the API
+	// relies on no cookie or HTTP authentication at all. Default value is false
+	ReflectCredentialedOrigin bool
 }
 
 // AddAllowMethods is allowed to add custom methods
@@ -100,11 +190,23 @@ func (c Config) getAllowedSchemas() []string {
 	if c.CustomSchemas != nil {
 		allowedSchemas = append(allowedSchemas, c.CustomSchemas...)
 	}
+	for _, scheme := range c.AllowedSchemes {
+		allowedSchemas = append(allowedSchemas, normalizeScheme(scheme))
+	}
 	return allowedSchemas
 }
 
+// normalizeScheme turns "Capacitor" or "capacitor:" into "capacitor://".
+func normalizeScheme(scheme string) string {
+	scheme = strings.ToLower(strings.TrimSpace(scheme))
+	scheme = strings.TrimSuffix(strings.TrimSuffix(scheme, "//"), ":")
+	return scheme + "://"
+}
+
 func (c Config) validateAllowedSchemas(origin string) bool {
 	allowedSchemas := c.getAllowedSchemas()
+	// origins are lower-cased by normalize before matching, compare schemes the same way
+	origin = strings.ToLower(origin)
 	for _, schema := range allowedSchemas {
 		if strings.HasPrefix(origin, schema) {
 			return true
@@ -118,20 +220,37 @@ func (c Config) Validate() error {
 	hasOriginFn := c.AllowOriginFunc != nil
 	hasOriginFn = hasOriginFn || c.AllowOriginWithContextFunc != nil
 
-	if c.AllowAllOrigins && (hasOriginFn || len(c.AllowOrigins) > 0) {
+	if c.AllowAllOrigins && (hasOriginFn || len(c.AllowOrigins) > 0 || len(c.AllowOriginRegexes) > 0) {
 		originFields := strings.Join([]string{
 			"AllowOriginFunc",
 			"AllowOriginFuncWithContext",
 			"AllowOrigins",
+			"AllowOriginRegexes",
 		}, " or ")
 		return fmt.Errorf(
 			"conflict settings: all origins enabled. %s is not needed",
 			originFields,
 		)
 	}
-	if !c.AllowAllOrigins && !hasOriginFn && len(c.AllowOrigins) == 0 {
+	if !c.AllowAllOrigins && !hasOriginFn && len(c.AllowOrigins) == 0 && len(c.AllowOriginRegexes) == 0 {
 		return errors.New("conflict settings: all origins disabled")
 	}
+	if c.ReflectCredentialedOrigin && !c.AllowAllOrigins && !slices.Contains(c.AllowOrigins, "*") {
+		return errors.New("conflict settings: ReflectCredentialedOrigin needs all origins enabled")
+	}
+	for _, pattern := range c.AllowOriginRegexes {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("bad origin regex %q: %v", pattern, err)
+		}
+	}
+	if c.MaxAge < 0 {
+		return errors.New("bad max age: MaxAge must not be negative")
+	}
+	for origin, maxAge := range c.MaxAgeByOrigin {
+		if maxAge < 0 {
+			return fmt.Errorf("bad max age: MaxAgeByOrigin[%q] must not be negative", origin)
+		}
+	}
 	for _, origin := range c.AllowOrigins {
 		if !strings.Contains(origin, "*") && !c.validateAllowedSchemas(origin) {
 			return errors.New("bad origin: origins must contain '*' or include " + strings.Join(c.getAllowedSchemas(), ","))
@@ -189,10 +308,100 @@ func Default() gin.HandlerFunc {
 	return New(config)
 }
 
-// New returns the location middleware with user-defined custom configuration.
+// NewMulti returns the location middleware trying several policies in order, e.g. tenant A,
+// tenant B, then a default. The first policy accepting the request origin (through its
+// AllowOrigins, wildcards or origin funcs, which may inspect the host or path) handles the
+// request and all CORS headers come from that single policy; they are never merged. When no
+// policy accepts the origin, the last one rejects the request.
+func NewMulti(policies ...Config) gin.HandlerFunc {
+	if len(policies) == 0 {
+		panic("gcors: NewMulti needs at least one policy")
+	}
+	cors := make([]*gCors, 0, len(policies))
+	for _, policy := range policies {
+		cors = append(cors, newCors(policy))
+	}
+	return func(c *gin.Context) {
+		if cors[len(cors)-1].multipleOrigins(c) {
+			cors[len(cors)-1].rejectWith(c, "multiple-origins")
+			return
+		}
+		origin, ok := corsOrigin(c)
+		if !ok {
+			return
+		}
+		for _, policy := range cors {
+			if policy.isOriginValid(c, origin) {
+				policy.allow(c, origin)
+				return
+			}
+		}
+		cors[len(cors)-1].reject(c, origin)
+	}
+}
+
+// DevConfig returns a permissive configuration for local development. Any origin is
+// reflected back together with Access-Control-Allow-Credentials, so "*" is never sent
+// alongside credentials.
+func DevConfig() Config {
+	return Config{
+		AllowOriginFunc:  func(origin string) bool { return true },
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", "Accept", "Authorization", "X-Requested-With"},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+	}
+}
+
+// Dev returns the location middleware with DevConfig. It prints a warning when the
+// process looks like a production deployment.
+func Dev() gin.HandlerFunc {
+	if isProduction() {
+		fmt.Fprintln(gin.DefaultErrorWriter, "[GCORS] [WARNING] gcors.Dev() reflects every origin with credentials and must not be used in production")
+	}
+	return New(DevConfig())
+}
+
+// isProduction reports whether gin runs in release mode or a common environment
+// variable names a production environment.
+func isProduction() bool {
+	if gin.Mode() == gin.ReleaseMode {
+		return true
+	}
+	for _, key := range []string{"APP_ENV", "GO_ENV", "ENV"} {
+		switch strings.ToLower(os.Getenv(key)) {
+		case "prod", "production":
+			return true
+		}
+	}
+	return false
+}
+
+// New returns the location middleware with user-defined custom configuration. Each call builds
+// its own policy and nothing is shared between them, so route groups can mount different
+// configs, e.g. GET only on one group and full CRUD on another.
 func New(config Config) gin.HandlerFunc {
 	cors := newCors(config)
 	return func(c *gin.Context) {
 		cors.applyCors(c)
 	}
 }
+
+// SimulatePreflight returns the headers the middleware built from config would send in answer
+// to a preflight request from origin for method and the given request headers, without a
+// running server. A rejected origin gets no Access-Control-Allow-Origin header. It is meant
+// for unit testing CORS policies.
+func SimulatePreflight(config Config, origin, method string, headers ...string) http.Header {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodOptions, "/", nil)
+	c.Request.Host = ""
+	c.Request.Header.Set("Origin", origin)
+	c.Request.Header.Set("Access-Control-Request-Method", method)
+	if len(headers) > 0 {
+		c.Request.Header.Set("Access-Control-Request-Headers", strings.Join(headers, ","))
+	}
+	newCors(config).applyCors(c)
+	c.Writer.WriteHeaderNow()
+	return w.Header()
+}
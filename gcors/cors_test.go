@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -199,9 +200,45 @@ func TestGeneratePreflightHeaders_AllowPrivateNetwork(t *testing.T) {
 	header := generatePreflightHeaders(Config{
 		AllowPrivateNetwork: true,
 	})
-	assert.Equal(t, header.Get("Access-Control-Allow-Private-Network"), "true")
-	assert.Equal(t, header.Get("Vary"), "Origin")
-	assert.Len(t, header, 2)
+	// only echoed to preflights requesting it
+	assert.Empty(t, header.Get("Access-Control-Allow-Private-Network"))
+	assert.Contains(t, header.Values("Vary"), "Access-Control-Request-Private-Network")
+	assert.Len(t, header, 1)
+}
+
+func TestPrivateNetworkPreflight(t *testing.T) {
+	preflight := func(router *gin.Engine, requested string) *httptest.ResponseRecorder {
+		h := http.Header{"Access-Control-Request-Method": {"GET"}}
+		if requested != "" {
+			h.Set("Access-Control-Request-Private-Network", requested)
+		}
+		return performRequestWithHeaders(router, "OPTIONS", "/", "https://dashboard.example.com", h)
+	}
+	for _, config := range []Config{
+		{AllowOrigins: []string{"https://dashboard.example.com"}},
+		{AllowOriginFunc: func(string) bool { return true }},
+		{AllowAllOrigins: true},
+	} {
+		router := newTestRouter(config)
+		w := preflight(router, "true")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.NotContains(t, w.Header(), "Access-Control-Allow-Private-Network")
+
+		config.AllowPrivateNetwork = true
+		router = newTestRouter(config)
+		w = preflight(router, "true")
+		assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Private-Network"))
+		assert.Contains(t, w.Header().Values("Vary"), "Access-Control-Request-Private-Network")
+		w = preflight(router, "")
+		assert.NotContains(t, w.Header(), "Access-Control-Allow-Private-Network")
+		w = preflight(router, "false")
+		assert.NotContains(t, w.Header(), "Access-Control-Allow-Private-Network")
+
+		// actual requests never get it
+		w = performRequestWithHeaders(router, "GET", "/", "https://dashboard.example.com",
+			http.Header{"Access-Control-Request-Private-Network": {"true"}})
+		assert.NotContains(t, w.Header(), "Access-Control-Allow-Private-Network")
+	}
 }
 
 func TestGeneratePreflightHeaders_AllowMethods(t *testing.T) {
@@ -231,6 +268,31 @@ func TestGeneratePreflightHeaders_MaxAge(t *testing.T) {
 	assert.Len(t, header, 2)
 }
 
+func TestPreflightMaxAge(t *testing.T) {
+	for maxAge, want := range map[time.Duration]string{
+		0:                                     "",
+		500 * time.Millisecond:                "",
+		90 * time.Second:                      "90",
+		90*time.Second + 999*time.Millisecond: "90",
+		24 * time.Hour:                        "86400",
+	} {
+		router := newTestRouter(Config{
+			AllowOrigins: []string{"http://google.com"},
+			MaxAge:       maxAge,
+		})
+		w := performRequest(router, "OPTIONS", "http://google.com")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, want, w.Header().Get("Access-Control-Max-Age"), maxAge)
+		if want == "" {
+			assert.NotContains(t, w.Header(), "Access-Control-Max-Age", maxAge)
+		}
+
+		// actual requests never carry it
+		w = performRequest(router, "GET", "http://google.com")
+		assert.NotContains(t, w.Header(), "Access-Control-Max-Age", maxAge)
+	}
+}
+
 func TestValidateOrigin(t *testing.T) {
 	cors := newCors(Config{
 		AllowAllOrigins: true,
@@ -644,3 +706,896 @@ func TestParseWildcardRules(t *testing.T) {
 		})
 	}
 }
+
+func TestOptionsResponseBodyAndHeaders(t *testing.T) {
+	router := newTestRouter(Config{
+		AllowOrigins:        []string{"http://google.com"},
+		AllowMethods:        []string{"GET"},
+		OptionsResponseBody: "ok",
+		OptionsResponseHeaders: http.Header{
+			"X-Preflight": []string{"handled"},
+		},
+	})
+
+	w := performRequest(router, "OPTIONS", "http://google.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", w.Body.String())
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "handled", w.Header().Get("X-Preflight"))
+	assert.Equal(t, "http://google.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	// actual requests are not affected
+	w = performRequest(router, "GET", "http://google.com")
+	assert.Equal(t, "get", w.Body.String())
+	assert.Empty(t, w.Header().Get("X-Preflight"))
+
+	// default stays an empty 204
+	router = newTestRouter(Config{
+		AllowOrigins: []string{"http://google.com"},
+	})
+	w = performRequest(router, "OPTIONS", "http://google.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Body.String())
+}
+
+func TestDevConfig(t *testing.T) {
+	router := newTestRouter(DevConfig())
+	w := performRequest(router, "GET", "http://google.com")
+	assert.Equal(t, "get", w.Body.String())
+	assert.Equal(t, "http://google.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+
+	w = performRequest(router, "OPTIONS", "http://localhost:3000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "http://localhost:3000", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestIsProduction(t *testing.T) {
+	t.Setenv("APP_ENV", "")
+	t.Setenv("GO_ENV", "")
+	t.Setenv("ENV", "")
+	assert.False(t, isProduction())
+
+	t.Setenv("APP_ENV", "Production")
+	assert.True(t, isProduction())
+}
+
+func TestCanonicalHeaders(t *testing.T) {
+	values := canonicalHeaders([]string{" Content-Type ", "content-type", "", "  ", "x-USER-id", "X-User-Id "})
+	assert.Equal(t, []string{"Content-Type", "X-User-Id"}, values)
+	assert.Nil(t, canonicalHeaders(nil))
+
+	router := newTestRouter(Config{
+		AllowOrigins:  []string{"http://google.com"},
+		AllowHeaders:  []string{" content-type ", "Content-Type", " ", "x-requested-with"},
+		ExposeHeaders: []string{"x-total-count ", "", " X-TOTAL-COUNT"},
+	})
+	w := performRequest(router, "OPTIONS", "http://google.com")
+	assert.Equal(t, "Content-Type,X-Requested-With", w.Header().Get("Access-Control-Allow-Headers"))
+
+	w = performRequest(router, "GET", "http://google.com")
+	assert.Equal(t, "X-Total-Count", w.Header().Get("Access-Control-Expose-Headers"))
+
+	header := generatePreflightHeaders(Config{AllowHeaders: []string{" ", ""}})
+	assert.Empty(t, header.Get("Access-Control-Allow-Headers"))
+}
+
+func TestPreflightAllowCredentials(t *testing.T) {
+	router := newTestRouter(Config{
+		AllowOrigins:     []string{"http://google.com"},
+		AllowMethods:     []string{"GET", "POST"},
+		AllowCredentials: true,
+	})
+
+	w := performRequest(router, "OPTIONS", "http://google.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "http://google.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+
+	w = performRequest(router, "OPTIONS", "http://example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestDebugRejectHeaders(t *testing.T) {
+	router := newTestRouter(Config{
+		AllowOrigins:       []string{"http://google.com"},
+		DebugRejectHeaders: true,
+	})
+	w := performRequest(router, "GET", "http://example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "origin-not-allowed", w.Header().Get("X-CORS-Rejected-Reason"))
+
+	w = performRequest(router, "GET", "http://google.com")
+	assert.Empty(t, w.Header().Get("X-CORS-Rejected-Reason"))
+
+	router = newTestRouter(Config{
+		AllowOrigins:       []string{"https://*.google.com"},
+		AllowWildcard:      true,
+		DebugRejectHeaders: true,
+	})
+	w = performRequest(router, "GET", "https://example.com")
+	assert.Equal(t, "wildcard-mismatch", w.Header().Get("X-CORS-Rejected-Reason"))
+
+	router = newTestRouter(Config{
+		AllowOriginFunc:    func(origin string) bool { return false },
+		DebugRejectHeaders: true,
+	})
+	w = performRequest(router, "GET", "https://example.com")
+	assert.Equal(t, "blocked", w.Header().Get("X-CORS-Rejected-Reason"))
+
+	// off by default
+	router = newTestRouter(Config{
+		AllowOrigins: []string{"http://google.com"},
+	})
+	w = performRequest(router, "GET", "http://example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("X-CORS-Rejected-Reason"))
+}
+
+func TestAllowedSchemes(t *testing.T) {
+	assert.Equal(t, "capacitor://", normalizeScheme(" Capacitor "))
+	assert.Equal(t, "chrome-extension://", normalizeScheme("chrome-extension://"))
+	assert.Equal(t, "app://", normalizeScheme("app:"))
+
+	c := Config{
+		AllowOrigins: []string{"chrome-extension://abcdefgh"},
+	}
+	assert.Error(t, c.Validate())
+
+	c.AllowedSchemes = []string{"chrome-extension"}
+	assert.NoError(t, c.Validate())
+
+	router := newTestRouter(Config{
+		AllowOrigins:   []string{"Chrome-Extension://abcdefgh", "capacitor://localhost"},
+		AllowedSchemes: []string{"chrome-extension", "CAPACITOR://"},
+	})
+	w := performRequest(router, "GET", "chrome-extension://abcdefgh")
+	assert.Equal(t, "get", w.Body.String())
+	assert.Equal(t, "chrome-extension://abcdefgh", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = performRequest(router, "GET", "capacitor://localhost")
+	assert.Equal(t, "capacitor://localhost", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = performRequest(router, "GET", "chrome-extension://other")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestNewMulti(t *testing.T) {
+	assert.Panics(t, func() { NewMulti() })
+
+	router := gin.New()
+	router.Use(NewMulti(
+		Config{
+			AllowOrigins:     []string{"https://tenant-a.com"},
+			AllowMethods:     []string{"GET"},
+			AllowCredentials: true,
+		},
+		Config{
+			AllowOriginWithContextFunc: func(c *gin.Context, origin string) bool {
+				return strings.HasPrefix(c.Request.URL.Path, "/b") && origin == "https://tenant-b.com"
+			},
+			AllowMethods: []string{"GET", "POST"},
+		},
+		Config{
+			AllowOrigins: []string{"https://default.com"},
+			AllowMethods: []string{"GET", "DELETE"},
+		},
+	))
+	router.GET("/b", func(c *gin.Context) {
+		c.String(http.StatusOK, "b")
+	})
+
+	w := performRequestWithHeaders(router, "OPTIONS", "/b", "https://tenant-a.com", http.Header{})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "GET", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+
+	w = performRequestWithHeaders(router, "OPTIONS", "/b", "https://tenant-b.com", http.Header{})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "GET,POST", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+
+	w = performRequestWithHeaders(router, "GET", "/b", "https://default.com", http.Header{})
+	assert.Equal(t, "b", w.Body.String())
+	assert.Equal(t, "https://default.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = performRequestWithHeaders(router, "GET", "/b", "https://unknown.com", http.Header{})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequestWithHeaders(router, "GET", "/b", "", http.Header{})
+	assert.Equal(t, "b", w.Body.String())
+}
+
+func TestStripDefaultPort(t *testing.T) {
+	assert.Equal(t, "https://example.com", stripDefaultPort("https://example.com:443"))
+	assert.Equal(t, "http://example.com", stripDefaultPort("http://example.com:80"))
+	assert.Equal(t, "wss://example.com", stripDefaultPort("wss://example.com:443"))
+	assert.Equal(t, "https://example.com:80", stripDefaultPort("https://example.com:80"))
+	assert.Equal(t, "http://example.com:8080", stripDefaultPort("http://example.com:8080"))
+	assert.Equal(t, "http://[::1]", stripDefaultPort("http://[::1]:80"))
+	assert.Equal(t, "http://[::1]", stripDefaultPort("http://[::1]"))
+	assert.Equal(t, "example.com:443", stripDefaultPort("example.com:443"))
+
+	cors := newCors(Config{
+		AllowOrigins: []string{"https://example.com", "http://api.example.com:80", "http://local.dev:8080"},
+	})
+	assert.True(t, cors.validateOrigin("https://example.com:443"))
+	assert.True(t, cors.validateOrigin("https://example.com"))
+	assert.True(t, cors.validateOrigin("http://api.example.com"))
+	assert.True(t, cors.validateOrigin("http://local.dev:8080"))
+	assert.False(t, cors.validateOrigin("http://local.dev"))
+	assert.False(t, cors.validateOrigin("https://example.com:8443"))
+}
+
+func TestEnforceMethodsAndHeaders(t *testing.T) {
+	router := newTestRouter(Config{
+		AllowOrigins:       []string{"http://example.com"},
+		AllowMethods:       []string{"GET", "POST", "PATCH"},
+		AllowHeaders:       []string{"Content-Type", "x-legacy-token"},
+		EnforceMethods:     []string{"get", "POST"},
+		EnforceHeaders:     []string{"Content-Type"},
+		DebugRejectHeaders: true,
+	})
+
+	// the preflight stays lenient
+	w := performRequestWithHeaders(router, "OPTIONS", "/", "http://example.com", http.Header{
+		"Access-Control-Request-Method": {"PATCH"},
+	})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "GET,POST,PATCH", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type,X-Legacy-Token", w.Header().Get("Access-Control-Allow-Headers"))
+
+	// actual requests are checked against the stricter set
+	w = performRequest(router, "PATCH", "http://example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "method-not-enforced", w.Header().Get("X-CORS-Rejected-Reason"))
+
+	w = performRequestWithHeaders(router, "POST", "/", "http://example.com", http.Header{
+		"X-Legacy-Token": {"secret"},
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "header-not-enforced", w.Header().Get("X-CORS-Rejected-Reason"))
+
+	w = performRequestWithHeaders(router, "POST", "/", "http://example.com", http.Header{
+		"Content-Type": {"application/json"},
+		"X-Other":      {"1"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "http://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	// same-origin requests are not CORS requests and are never enforced
+	w = performRequestWithHeaders(router, "PATCH", "/", "", http.Header{})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestMaxAgeByOrigin(t *testing.T) {
+	router := newTestRouter(Config{
+		AllowOrigins: []string{"https://partner.com", "https://other.com", "https://untrusted.com"},
+		AllowMethods: []string{"GET"},
+		MaxAge:       10 * time.Minute,
+		MaxAgeByOrigin: map[string]time.Duration{
+			"https://Partner.com:443": 24 * time.Hour,
+			"https://untrusted.com":   0,
+		},
+	})
+	preflight := func(origin string) string {
+		w := performRequest(router, "OPTIONS", origin)
+		return w.Header().Get("Access-Control-Max-Age")
+	}
+
+	assert.Equal(t, "86400", preflight("https://partner.com"))
+	assert.Equal(t, "0", preflight("https://untrusted.com"))
+	assert.Equal(t, "600", preflight("https://other.com"))
+	assert.Equal(t, "86400", preflight("https://partner.com"))
+
+	assert.PanicsWithValue(t, `bad max age: MaxAgeByOrigin["https://partner.com"] must not be negative`, func() {
+		New(Config{
+			AllowOrigins:   []string{"https://partner.com"},
+			MaxAgeByOrigin: map[string]time.Duration{"https://partner.com": -time.Second},
+		})
+	})
+}
+
+func TestMultipleOriginHeaders(t *testing.T) {
+	config := Config{
+		AllowOrigins:       []string{"http://trusted.com"},
+		DebugRejectHeaders: true,
+	}
+	router := newTestRouter(config)
+
+	w := performRequestWithHeaders(router, "GET", "/", "", http.Header{
+		"Origin": {"http://trusted.com", "http://evil.com"},
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "multiple-origins", w.Header().Get("X-CORS-Rejected-Reason"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = performRequestWithHeaders(router, "GET", "/", "", http.Header{
+		"Origin": {"http://trusted.com http://evil.com"},
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = performRequestWithHeaders(router, "GET", "/", "", http.Header{
+		"Origin": {"http://trusted.com", "http://trusted.com"},
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	config.AllowDuplicateOrigins = true
+	router = newTestRouter(config)
+	w = performRequestWithHeaders(router, "GET", "/", "", http.Header{
+		"Origin": {"http://trusted.com", "http://trusted.com"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "http://trusted.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = performRequestWithHeaders(router, "GET", "/", "", http.Header{
+		"Origin": {"http://trusted.com", "http://evil.com"},
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	multi := gin.New()
+	multi.Use(NewMulti(Config{AllowOrigins: []string{"http://trusted.com"}}))
+	multi.GET("/", func(c *gin.Context) {})
+	w = performRequestWithHeaders(multi, "GET", "/", "", http.Header{
+		"Origin": {"http://trusted.com", "http://evil.com"},
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestSimulatePreflight(t *testing.T) {
+	config := Config{
+		AllowOrigins:   []string{"https://app.example.com"},
+		AllowMethods:   []string{"GET", "POST"},
+		AllowHeaders:   []string{"content-type", "X-Api-Key"},
+		MaxAge:         time.Hour,
+		MaxAgeByOrigin: map[string]time.Duration{"https://app.example.com": 2 * time.Hour},
+	}
+
+	header := SimulatePreflight(config, "https://app.example.com", "POST", "Content-Type")
+	assert.Equal(t, "https://app.example.com", header.Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "GET,POST", header.Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Content-Type,X-Api-Key", header.Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "7200", header.Get("Access-Control-Max-Age"))
+	assert.Equal(t, []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}, header.Values("Vary"))
+
+	// the same headers as a real preflight through the middleware
+	w := performRequestWithHeaders(newTestRouter(config), "OPTIONS", "/", "https://app.example.com", http.Header{
+		"Access-Control-Request-Method":  {"POST"},
+		"Access-Control-Request-Headers": {"Content-Type"},
+	})
+	assert.Equal(t, w.Header(), header)
+
+	header = SimulatePreflight(config, "https://evil.example.com", "POST")
+	assert.Empty(t, header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestAuthorizedKey(t *testing.T) {
+	router := gin.New()
+	router.Use(New(Config{
+		AllowOrigins:     []string{"https://app.example.com"},
+		AllowMethods:     []string{"GET"},
+		AllowHeaders:     []string{"Authorization"},
+		AllowCredentials: true,
+		AuthorizedKey:    "authorized",
+	}))
+	router.Use(func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "Bearer ok" {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set("authorized", true)
+	})
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "get")
+	})
+	router.GET("/empty", func(c *gin.Context) {})
+
+	w := performRequestWithHeaders(router, "GET", "/", "https://app.example.com", http.Header{
+		"Authorization": {"Bearer ok"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "get", w.Body.String())
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+
+	// a handler writing no body still gets the headers
+	w = performRequestWithHeaders(router, "GET", "/empty", "https://app.example.com", http.Header{
+		"Authorization": {"Bearer ok"},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+
+	w = performRequest(router, "GET", "https://app.example.com")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+	// so that a shared cache keeps it apart from the authorized variant
+	assert.Equal(t, []string{"Origin"}, w.Header().Values("Vary"))
+
+	// preflights are answered before the auth middleware runs
+	w = performRequestWithHeaders(router, "OPTIONS", "/", "https://app.example.com", http.Header{
+		"Access-Control-Request-Method":  {"GET"},
+		"Access-Control-Request-Headers": {"Authorization"},
+	})
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = performRequest(router, "GET", "https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestPrecomputedOriginHeaders(t *testing.T) {
+	listed := Config{
+		AllowOrigins:     []string{"https://a.example.com", "https://b.example.com"},
+		AllowMethods:     []string{"GET", "POST"},
+		AllowHeaders:     []string{"X-Token"},
+		ExposeHeaders:    []string{"X-Total"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+		MaxAgeByOrigin:   map[string]time.Duration{"https://b.example.com": time.Minute},
+	}
+	dynamic := listed
+	dynamic.AllowOrigins = nil
+	dynamic.AllowOriginFunc = func(origin string) bool { return strings.HasSuffix(origin, ".example.com") }
+
+	listedRouter, dynamicRouter := newTestRouter(listed), newTestRouter(dynamic)
+	for _, origin := range []string{"https://a.example.com", "https://b.example.com"} {
+		for _, method := range []string{"GET", "OPTIONS"} {
+			want := performRequest(dynamicRouter, method, origin)
+			got := performRequest(listedRouter, method, origin)
+			assert.Equal(t, want.Code, got.Code)
+			assert.Equal(t, want.Header(), got.Header(), "%s %s", method, origin)
+		}
+	}
+
+	// Non-normalized origins are not precomputed and still reflect the value sent.
+	w := performRequest(listedRouter, "GET", "https://a.example.com:443")
+	assert.Equal(t, "https://a.example.com:443", w.Header().Get("Access-Control-Allow-Origin"))
+
+	// Headers added downstream must not leak into the precomputed set.
+	router := gin.New()
+	router.Use(New(listed))
+	router.GET("/", func(c *gin.Context) {
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		c.Status(http.StatusOK)
+	})
+	performRequest(router, "GET", "https://a.example.com")
+	w = performRequest(router, "GET", "https://a.example.com")
+	assert.Equal(t, []string{"Origin", "Accept-Encoding"}, w.Header().Values("Vary"))
+}
+
+func benchmarkOrigin(b *testing.B, config Config) {
+	router := newTestRouter(config)
+	req, _ := http.NewRequestWithContext(context.Background(), "GET", "/", nil)
+	req.Header.Set("Origin", "https://b.example.com")
+	w := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clear(w.Header())
+		router.ServeHTTP(w, req)
+	}
+}
+
+func BenchmarkOriginHeadersPrecomputed(b *testing.B) {
+	benchmarkOrigin(b, Config{
+		AllowOrigins:  []string{"https://a.example.com", "https://b.example.com"},
+		AllowMethods:  []string{"GET"},
+		ExposeHeaders: []string{"X-Total"},
+	})
+}
+
+func BenchmarkOriginHeadersDynamic(b *testing.B) {
+	benchmarkOrigin(b, Config{
+		AllowOriginFunc: func(origin string) bool { return origin == "https://b.example.com" },
+		AllowMethods:    []string{"GET"},
+		ExposeHeaders:   []string{"X-Total"},
+	})
+}
+
+func TestPreflightCache(t *testing.T) {
+	cors := newCors(Config{
+		AllowOrigins:   []string{"https://*.example.com"},
+		AllowWildcard:  true,
+		AllowMethods:   []string{"GET"},
+		MaxAgeByOrigin: map[string]time.Duration{"https://a.example.com": time.Minute},
+	})
+	cors.preflightCacheSize = 2
+	router := gin.New()
+	router.Use(cors.applyCors)
+
+	for i := 0; i < 2; i++ {
+		w := performRequest(router, "OPTIONS", "https://a.example.com")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "https://a.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "60", w.Header().Get("Access-Control-Max-Age"))
+		assert.Equal(t, "GET", w.Header().Get("Access-Control-Allow-Methods"))
+	}
+	w := performRequest(router, "OPTIONS", "https://b.example.com")
+	assert.Equal(t, "https://b.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Max-Age"))
+
+	// past the size limit headers are still built, just not kept
+	w = performRequest(router, "OPTIONS", "https://c.example.com")
+	assert.Equal(t, "https://c.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	_, cached := cors.preflightCache.Load("https://c.example.com")
+	assert.False(t, cached)
+
+	// a cached origin is still validated
+	w = performRequest(router, "OPTIONS", "https://a.example.org")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func benchmarkPreflight(b *testing.B, cacheSize int64) {
+	cors := newCors(Config{
+		AllowOrigins:  []string{"https://*.example.com"},
+		AllowWildcard: true,
+		AllowMethods:  []string{"GET", "POST"},
+		AllowHeaders:  []string{"Authorization", "Content-Type"},
+		MaxAge:        time.Hour,
+	})
+	cors.preflightCacheSize = cacheSize
+	router := gin.New()
+	router.Use(cors.applyCors)
+	req, _ := http.NewRequestWithContext(context.Background(), "OPTIONS", "/", nil)
+	req.Header.Set("Origin", "https://b.example.com")
+	w := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clear(w.Header())
+		router.ServeHTTP(w, req)
+	}
+}
+
+func BenchmarkPreflightCached(b *testing.B) {
+	benchmarkPreflight(b, preflightCacheSize)
+}
+
+func BenchmarkPreflightUncached(b *testing.B) {
+	benchmarkPreflight(b, 0)
+}
+
+func TestAllowOriginRegexes(t *testing.T) {
+	assert.Panics(t, func() { New(Config{AllowOriginRegexes: []string{"("}}) })
+	assert.Panics(t, func() { New(Config{AllowAllOrigins: true, AllowOriginRegexes: []string{"^x$"}}) })
+
+	var funcCalls int
+	router := newTestRouter(Config{
+		AllowOrigins:       []string{"https://exact.net"},
+		AllowOriginRegexes: []string{`^https://.*\.example\.(com|org)$`},
+		AllowOriginFunc: func(origin string) bool {
+			funcCalls++
+			return origin == "https://func.net"
+		},
+		AllowMethods:       []string{"GET"},
+		DebugRejectHeaders: true,
+	})
+
+	for origin, want := range map[string]int{
+		"https://api.example.com":      http.StatusOK,
+		"https://a.b.example.org":      http.StatusOK,
+		"https://exact.net":            http.StatusOK,
+		"https://func.net":             http.StatusOK,
+		"https://api.example.net":      http.StatusForbidden,
+		"http://api.example.com":       http.StatusForbidden,
+		"https://api.example.com.evil": http.StatusForbidden,
+	} {
+		w := performRequest(router, "GET", origin)
+		assert.Equal(t, want, w.Code, origin)
+		if want == http.StatusOK {
+			assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"), origin)
+		}
+	}
+	// exact entries and regexes are checked before AllowOriginFunc
+	assert.Equal(t, 4, funcCalls)
+
+	router = newTestRouter(Config{AllowOriginRegexes: []string{`^https://.*\.example\.(com|org)$`}, DebugRejectHeaders: true})
+	w := performRequest(router, "GET", "https://example.net")
+	assert.Equal(t, "regex-mismatch", w.Header().Get("X-CORS-Rejected-Reason"))
+}
+
+func TestNegotiateHeaders(t *testing.T) {
+	preflight := func(router *gin.Engine, origin, requested string) *httptest.ResponseRecorder {
+		return performRequestWithHeaders(router, "OPTIONS", "/", origin, http.Header{
+			"Access-Control-Request-Method":  {"GET"},
+			"Access-Control-Request-Headers": {requested},
+		})
+	}
+	allowHeaders := []string{"Authorization", "Content-Type", "X-Request-Id"}
+
+	for _, config := range []Config{
+		{AllowOrigins: []string{"https://a.example.com"}, AllowHeaders: allowHeaders, NegotiateHeaders: true},
+		{AllowOriginFunc: func(string) bool { return true }, AllowHeaders: allowHeaders, NegotiateHeaders: true},
+		{AllowAllOrigins: true, AllowHeaders: allowHeaders, NegotiateHeaders: true},
+	} {
+		router := newTestRouter(config)
+
+		// partial overlap: only the allowed part comes back, in the requested order
+		w := preflight(router, "https://a.example.com", "x-request-id, X-Unknown,content-type")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, "X-Request-Id,Content-Type", w.Header().Get("Access-Control-Allow-Headers"))
+		assert.Contains(t, w.Header().Values("Vary"), "Access-Control-Request-Headers")
+
+		// no overlap
+		w = preflight(router, "https://a.example.com", "X-Unknown")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.NotContains(t, w.Header(), "Access-Control-Allow-Headers")
+
+		// the precomputed headers are left untouched
+		w = preflight(router, "https://a.example.com", "Authorization")
+		assert.Equal(t, "Authorization", w.Header().Get("Access-Control-Allow-Headers"))
+	}
+
+	router := newTestRouter(Config{
+		AllowOrigins:            []string{"https://a.example.com"},
+		AllowHeaders:            allowHeaders,
+		RejectDisallowedHeaders: true,
+		DebugRejectHeaders:      true,
+	})
+	w := preflight(router, "https://a.example.com", "Content-Type,X-Unknown")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "header-not-allowed", w.Header().Get("X-CORS-Rejected-Reason"))
+	w = preflight(router, "https://a.example.com", "content-type, authorization")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "Authorization,Content-Type,X-Request-Id", w.Header().Get("Access-Control-Allow-Headers"))
+}
+
+func TestOnOriginDenied(t *testing.T) {
+	var denied []string
+	router := newTestRouter(Config{
+		AllowOrigins: []string{"https://a.example.com"},
+		OnOriginDenied: func(c *gin.Context, origin string) {
+			denied = append(denied, origin)
+			if c.Request.Method == "POST" {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "origin not allowed"})
+			}
+		},
+	})
+
+	w := performRequest(router, "GET", "https://a.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, denied)
+
+	w = performRequest(router, "GET", "https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	w = performRequest(router, "POST", "https://evil.example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.JSONEq(t, `{"error":"origin not allowed"}`, w.Body.String())
+	assert.Equal(t, []string{"https://evil.example.com", "https://evil.example.com"}, denied)
+
+	// NewMulti calls the hook of the last policy
+	denied = nil
+	router = gin.New()
+	router.Use(NewMulti(
+		Config{AllowOrigins: []string{"https://a.example.com"}},
+		Config{AllowOrigins: []string{"https://b.example.com"}, OnOriginDenied: func(c *gin.Context, origin string) {
+			denied = append(denied, origin)
+		}},
+	))
+	router.GET("/", func(c *gin.Context) {})
+	w = performRequest(router, "GET", "https://c.example.com")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, []string{"https://c.example.com"}, denied)
+}
+
+func TestPerGroupPolicies(t *testing.T) {
+	readOnly := DefaultConfig()
+	readOnly.AllowOrigins = []string{"https://a.example.com"}
+	readOnly.AllowMethods = []string{"GET"}
+	readOnly.EnforceMethods = []string{"GET"}
+	crud := DefaultConfig()
+	crud.AllowOrigins = []string{"https://a.example.com"}
+	crud.AllowMethods = []string{"GET", "POST", "PUT", "DELETE"}
+
+	router := gin.New()
+	read := router.Group("/read", New(readOnly))
+	read.Any("", func(c *gin.Context) { c.String(http.StatusOK, "read") })
+	write := router.Group("/write", New(crud))
+	write.Any("", func(c *gin.Context) { c.String(http.StatusOK, "write") })
+
+	preflight := func(path string) http.Header {
+		w := performRequestWithHeaders(router, "OPTIONS", path, "https://a.example.com",
+			http.Header{"Access-Control-Request-Method": {"POST"}})
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		return w.Header()
+	}
+	assert.Equal(t, "GET", preflight("/read").Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "GET,POST,PUT,DELETE", preflight("/write").Get("Access-Control-Allow-Methods"))
+
+	w := performRequestWithHeaders(router, "POST", "/read", "https://a.example.com", http.Header{})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = performRequestWithHeaders(router, "POST", "/write", "https://a.example.com", http.Header{})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// building a policy leaves the config, and so the other policies, untouched
+	assert.Equal(t, []string{"GET", "POST", "PUT", "DELETE"}, crud.AllowMethods)
+	assert.Equal(t, []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}, DefaultConfig().AllowMethods)
+}
+
+func TestIDNOrigins(t *testing.T) {
+	router := newTestRouter(Config{
+		AllowOrigins:   []string{"https://bücher.example", "https://xn--caf-dma.example:8443"},
+		AllowMethods:   []string{"GET"},
+		MaxAgeByOrigin: map[string]time.Duration{"https://Bücher.example": time.Minute},
+	})
+
+	for origin, want := range map[string]int{
+		"https://xn--bcher-kva.example":     http.StatusOK,
+		"https://bücher.example":            http.StatusOK,
+		"https://café.example:8443":         http.StatusOK,
+		"https://xn--caf-dma.example:8443":  http.StatusOK,
+		"https://xn--caf-dma.example":       http.StatusForbidden,
+		"https://xn--bcher-kva.example.com": http.StatusForbidden,
+	} {
+		w := performRequest(router, "GET", origin)
+		assert.Equal(t, want, w.Code, origin)
+		if want == http.StatusOK {
+			assert.Equal(t, origin, w.Header().Get("Access-Control-Allow-Origin"), origin)
+		}
+	}
+
+	w := performRequest(router, "OPTIONS", "https://xn--bcher-kva.example")
+	assert.Equal(t, "60", w.Header().Get("Access-Control-Max-Age"))
+	assert.Equal(t, "https://xn--caf-dma.example:8443", canonicalOrigin("https://café.example:8443"))
+}
+
+func TestWildcardAnchoring(t *testing.T) {
+	cors := newCors(Config{
+		AllowOrigins:  []string{"https://*.github.com", "*.golang.org", "http://example.*.com", "http://localhost:*"},
+		AllowWildcard: true,
+	})
+	for origin, want := range map[string]bool{
+		"https://gist.github.com":              true,
+		"https://a.b.github.com":               true,
+		"https://evil.com/.github.com":         false,
+		"https://evil.com@x.github.com":        false,
+		"https://evil.com:.github.com":         false,
+		"https://gist.github.com.evil.com":     false,
+		"https://go.golang.org":                true,
+		"go.golang.org":                        true,
+		"https://evil.com/x.golang.org":        false,
+		"http://go.golang.org":                 true,
+		"javascript://x.golang.org":            false,
+		"file://x.golang.org":                  false,
+		"HTTPS://x.golang.org":                 false,
+		"http://example.com":                   false,
+		"http://example.api.com":               true,
+		"http://localhost:8080":                true,
+		"http://localhost:8080,https://evil.a": false,
+		"http://localhost:8080 evil":           false,
+	} {
+		assert.Equal(t, want, cors.validateOrigin(origin), origin)
+	}
+}
+
+// legacyWildcardMatch is the prefix/suffix matcher the anchored expressions replaced.
+func legacyWildcardMatch(rules [][]string, origin string) bool {
+	for _, w := range rules {
+		if w[0] == "*" && strings.HasSuffix(origin, w[1]) {
+			return true
+		}
+		if w[1] == "*" && strings.HasPrefix(origin, w[0]) {
+			return true
+		}
+		if strings.HasPrefix(origin, w[0]) && strings.HasSuffix(origin, w[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+var wellFormedOrigin = regexp.MustCompile(`^https?://[A-Za-z0-9.-]+(:[0-9]+)?$`)
+
+func TestReflectCredentialedOrigin(t *testing.T) {
+	assert.Panics(t, func() {
+		New(Config{AllowOrigins: []string{"http://google.com"}, ReflectCredentialedOrigin: true})
+	})
+	router := newTestRouter(Config{
+		AllowAllOrigins:           true,
+		AllowCredentials:          true,
+		AllowMethods:              []string{"GET"},
+		ReflectCredentialedOrigin: true,
+	})
+
+	// no credentials: wildcard, never along with Allow-Credentials
+	w := performRequest(router, "GET", "https://example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, []string{"Origin", "Cookie", "Authorization"}, w.Header().Values("Vary"))
+
+	for _, h := range []http.Header{
+		{"Cookie": {"session=1"}},
+		{"Authorization": {"Bearer token"}},
+	} {
+		w = performRequestWithHeaders(router, "GET", "/", "https://example.com", h)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "https://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+		assert.Equal(t, []string{"Origin", "Cookie", "Authorization"}, w.Header().Values("Vary"))
+	}
+
+	w = performRequest(router, "OPTIONS", "https://example.com")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Contains(t, w.Header().Values("Vary"), "Origin")
+
+	// the shared headers are left untouched
+	w = performRequest(router, "GET", "https://other.example")
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+
+	// authorized callers get the reflected origin too
+	router = gin.New()
+	router.Use(New(Config{
+		AllowAllOrigins:           true,
+		AllowMethods:              []string{"GET"},
+		ReflectCredentialedOrigin: true,
+		AuthorizedKey:             "authorized",
+	}))
+	router.Use(func(c *gin.Context) { c.Set("authorized", true) })
+	router.GET("/", func(c *gin.Context) { c.String(http.StatusOK, "get") })
+	w = performRequestWithHeaders(router, "GET", "/", "https://example.com", http.Header{"Cookie": {"session=1"}})
+	assert.Equal(t, "https://example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, []string{"Origin", "Cookie", "Authorization"}, w.Header().Values("Vary"))
+	w = performRequest(router, "GET", "https://example.com")
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func FuzzWildcardOrigin(f *testing.F) {
+	config := Config{
+		AllowOrigins:  []string{"https://*.github.com", "*.golang.org", "http://example.*.com", "http://localhost:*"},
+		AllowWildcard: true,
+	}
+	rules := config.parseWildcardRules()
+	compiled := compileWildcardRules(rules)
+	for _, seed := range []string{
+		"https://gist.github.com",
+		"https://evil.com/.github.com",
+		"https://evil.com@x.github.com",
+		"http://example.com",
+		"http://localhost:1234",
+		"http://localhost:1234, https://evil.com",
+		"x.golang.org",
+		"javascript://x.golang.org",
+		"file://x.golang.org",
+		"https://\x00.github.com",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, origin string) {
+		matched := false
+		for _, re := range compiled {
+			matched = matched || re.MatchString(origin)
+		}
+		legacy := legacyWildcardMatch(rules, origin)
+		if matched && !legacy {
+			t.Fatalf("%q is accepted by the anchored matcher only", origin)
+		}
+		if scheme, _, ok := strings.Cut(origin, "://"); matched && ok && scheme != "http" && scheme != "https" {
+			t.Fatalf("%q is accepted with a %q scheme", origin, scheme)
+		}
+		if !legacy || matched || !wellFormedOrigin.MatchString(origin) {
+			return
+		}
+		// the legacy matcher also accepted overlapping prefix and suffix, e.g.
+		// "http://example.com" for "http://example.*.com"
+		for _, w := range rules {
+			leading := w[0] == "*" && strings.HasSuffix(origin, w[1])
+			trailing := w[1] == "*" && strings.HasPrefix(origin, w[0])
+			middle := strings.HasPrefix(origin, w[0]) && strings.HasSuffix(origin, w[1]) && len(origin) >= len(w[0])+len(w[1])
+			if leading || trailing || middle {
+				t.Fatalf("well-formed %q is rejected by the anchored matcher", origin)
+			}
+		}
+	})
+}
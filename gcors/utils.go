@@ -2,9 +2,13 @@ package gcors
 
 import (
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
 )
 
 type converter func(string) string
@@ -14,8 +18,7 @@ func generateNormalHeaders(c Config) http.Header {
 	if c.AllowCredentials {
 		headers.Set("Access-Control-Allow-Credentials", "true")
 	}
-	if len(c.ExposeHeaders) > 0 {
-		exposeHeaders := convert(normalize(c.ExposeHeaders), http.CanonicalHeaderKey)
+	if exposeHeaders := canonicalHeaders(c.ExposeHeaders); len(exposeHeaders) > 0 {
 		headers.Set("Access-Control-Expose-Headers", strings.Join(exposeHeaders, ","))
 	}
 	if c.AllowAllOrigins {
@@ -36,18 +39,20 @@ func generatePreflightHeaders(c Config) http.Header {
 		value := strings.Join(allowMethods, ",")
 		headers.Set("Access-Control-Allow-Methods", value)
 	}
-	if len(c.AllowHeaders) > 0 {
-		allowHeaders := convert(normalize(c.AllowHeaders), http.CanonicalHeaderKey)
+	if allowHeaders := canonicalHeaders(c.AllowHeaders); len(allowHeaders) > 0 {
 		value := strings.Join(allowHeaders, ",")
 		headers.Set("Access-Control-Allow-Headers", value)
 	}
-	if c.MaxAge > time.Duration(0) {
-		value := strconv.FormatInt(int64(c.MaxAge/time.Second), 10)
+	if seconds := int64(c.MaxAge / time.Second); seconds > 0 {
+		// "0" would disable caching instead of leaving the browser default
+		value := strconv.FormatInt(seconds, 10)
 		headers.Set("Access-Control-Max-Age", value)
 	}
 
-	if c.AllowPrivateNetwork {
-		headers.Set("Access-Control-Allow-Private-Network", "true")
+	for key, values := range c.OptionsResponseHeaders {
+		for _, value := range values {
+			headers.Add(key, value)
+		}
 	}
 
 	if c.AllowAllOrigins {
@@ -61,6 +66,10 @@ func generatePreflightHeaders(c Config) http.Header {
 		headers.Add("Vary", "Access-Control-Request-Method")
 		headers.Add("Vary", "Access-Control-Request-Headers")
 	}
+	if c.AllowPrivateNetwork {
+		// Access-Control-Allow-Private-Network is only echoed to preflights asking for it
+		headers.Add("Vary", "Access-Control-Request-Private-Network")
+	}
 	return headers
 }
 
@@ -81,6 +90,119 @@ func normalize(values []string) []string {
 	return normalized
 }
 
+// defaultPorts are dropped from origins before comparing them.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+}
+
+// stripDefaultPort turns "https://example.com:443" into "https://example.com".
+// Non-default ports are kept.
+func stripDefaultPort(origin string) string {
+	scheme, rest, ok := strings.Cut(origin, "://")
+	if !ok {
+		return origin
+	}
+	i := strings.LastIndexByte(rest, ':')
+	if i < 0 || strings.HasSuffix(rest, "]") {
+		return origin
+	}
+	if port, ok := defaultPorts[strings.ToLower(scheme)]; ok && rest[i+1:] == port {
+		return scheme + "://" + rest[:i]
+	}
+	return origin
+}
+
+// Character classes a wildcard is compiled to, depending on its position in the origin.
+const (
+	// wildcardHost stands in the host or port, it cannot reach past them with '/', '@' or ':'.
+	wildcardHost = `[A-Za-z0-9.-]*`
+	// wildcardLeading may also cover the scheme, as in "*.example.com", but only http or https:
+	// a browser sends other schemes such as "javascript://" or "file://" from untrusted content.
+	wildcardLeading = `(?:https?://)?` + wildcardHost
+	// wildcardTrailing covers the rest of the origin, as in "http://*", but no space or comma
+	// that would smuggle a second origin.
+	wildcardTrailing = `[^\x00-\x20,]*`
+)
+
+// compileWildcardRules turns the prefix/suffix rules of parseWildcardRules into regular
+// expressions anchored at both ends, so no extra leading or trailing content can slip through.
+func compileWildcardRules(rules [][]string) []*regexp.Regexp {
+	var out []*regexp.Regexp
+	for _, rule := range rules {
+		var pattern string
+		switch {
+		case rule[0] == "*":
+			pattern = wildcardLeading + regexp.QuoteMeta(rule[1])
+		case rule[1] == "*":
+			pattern = regexp.QuoteMeta(rule[0]) + wildcardTrailing
+		default:
+			pattern = regexp.QuoteMeta(rule[0]) + wildcardHost + regexp.QuoteMeta(rule[1])
+		}
+		out = append(out, regexp.MustCompile("^"+pattern+"$"))
+	}
+	return out
+}
+
+// compileOriginRegexes compiles AllowOriginRegexes, which Validate has already checked.
+func compileOriginRegexes(patterns []string) []*regexp.Regexp {
+	var out []*regexp.Regexp
+	for _, pattern := range patterns {
+		out = append(out, regexp.MustCompile(pattern))
+	}
+	return out
+}
+
+// asciiOrigin converts the host of an internationalized origin to punycode, the form browsers
+// send in the Origin header, so "https://bücher.example" matches "https://xn--bcher-kva.example".
+// ASCII origins, and hosts idna rejects, are returned as they are.
+func asciiOrigin(origin string) string {
+	scheme, rest, ok := strings.Cut(origin, "://")
+	if !ok || isASCII(rest) {
+		return origin
+	}
+	host, port := rest, ""
+	if i := strings.LastIndexByte(rest, ':'); i >= 0 {
+		host, port = rest[:i], rest[i:]
+	}
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return origin
+	}
+	return scheme + "://" + ascii + port
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalOrigin is the form origins are compared in: punycode host, no default port.
+func canonicalOrigin(origin string) string {
+	return stripDefaultPort(asciiOrigin(origin))
+}
+
+// canonicalHeaders trims, drops empty entries, canonicalizes and dedupes header names.
+func canonicalHeaders(values []string) []string {
+	var out []string
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		value = http.CanonicalHeaderKey(strings.TrimSpace(value))
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		out = append(out, value)
+	}
+	return out
+}
+
 func convert(s []string, c converter) []string {
 	var out []string
 	for _, i := range s {
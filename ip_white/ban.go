@@ -0,0 +1,70 @@
+package ip_white
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// BanIP blocks ip for duration, even when a whitelist, User-Agent or certificate rule would
+// allow it. Banning an already banned ip replaces its expiry.
+func (g *Guard) BanIP(ip string, duration time.Duration) error {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("ip_white: invalid ip %q", ip)
+	}
+	now := g.now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for key, until := range g.bans {
+		if !now.Before(until) {
+			delete(g.bans, key)
+		}
+	}
+	g.bans[addr.String()] = now.Add(duration)
+	return nil
+}
+
+// UnbanIP lifts a ban before it expires.
+func (g *Guard) UnbanIP(ip string) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return
+	}
+	g.mu.Lock()
+	delete(g.bans, addr.String())
+	g.mu.Unlock()
+}
+
+// banned reports whether addr, or the IPv4 address it carries under WithNAT64Prefix, is
+// currently banned.
+func (g *Guard) banned(addr net.IP) bool {
+	if addr == nil {
+		return false
+	}
+	if g.bannedAddr(addr) {
+		return true
+	}
+	mapped, ok := g.nat64IPv4(addr)
+	return ok && g.bannedAddr(mapped)
+}
+
+// bannedAddr reports whether addr itself is currently banned, dropping the ban once expired.
+func (g *Guard) bannedAddr(addr net.IP) bool {
+	key := addr.String()
+	g.mu.RLock()
+	until, ok := g.bans[key]
+	g.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if g.now().Before(until) {
+		return true
+	}
+	g.mu.Lock()
+	if until, ok = g.bans[key]; ok && !g.now().Before(until) {
+		delete(g.bans, key)
+	}
+	g.mu.Unlock()
+	return false
+}
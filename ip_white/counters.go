@@ -0,0 +1,75 @@
+package ip_white
+
+// rule is the rule deciding a request, counted per Guard.
+type rule int
+
+const (
+	ruleNotListed rule = iota
+	ruleBanned
+	ruleWhitelist
+	ruleNAT64
+	ruleTemporary
+	rulePort
+	ruleSource
+	ruleFailOpen
+	ruleUserAgent
+	ruleClientCert
+	ruleMaintenance
+	ruleMaintenanceDenied
+	ruleCount
+)
+
+var ruleNames = [ruleCount]string{
+	ruleNotListed:         "not_listed",
+	ruleBanned:            "banned",
+	ruleWhitelist:         "whitelist",
+	ruleNAT64:             "nat64",
+	ruleTemporary:         "temporary",
+	rulePort:              "port",
+	ruleSource:            "ip_source",
+	ruleFailOpen:          "fail_open",
+	ruleUserAgent:         "user_agent",
+	ruleClientCert:        "client_cert",
+	ruleMaintenance:       "maintenance",
+	ruleMaintenanceDenied: "maintenance_denied",
+}
+
+func (r rule) allowed() bool {
+	return r >= ruleWhitelist && r != ruleMaintenanceDenied
+}
+
+// bypass reports a rule allowing the request whatever its IP.
+func (r rule) bypass() bool {
+	return r == ruleUserAgent || r == ruleClientCert
+}
+
+// Counters is a snapshot of the decisions taken by a Guard on requests. Allowed counts
+// requests let in by an IP rule, Bypassed those let in by a User-Agent or client certificate
+// rule, Denied the rejected ones. ByRule breaks them down by rule name: "whitelist", "nat64",
+// "temporary", "port", "ip_source", "fail_open", "user_agent", "client_cert", "maintenance",
+// "banned", "not_listed" and "maintenance_denied".
+type Counters struct {
+	Allowed  uint64
+	Denied   uint64
+	Bypassed uint64
+	ByRule   map[string]uint64
+}
+
+// Counters returns the decisions taken so far by the Handler and WrapHandler of the guard.
+// Direct Allowed calls are not counted.
+func (g *Guard) Counters() Counters {
+	counters := Counters{ByRule: make(map[string]uint64, ruleCount)}
+	for r := rule(0); r < ruleCount; r++ {
+		n := g.counts[r].Load()
+		counters.ByRule[ruleNames[r]] = n
+		switch {
+		case r.bypass():
+			counters.Bypassed += n
+		case r.allowed():
+			counters.Allowed += n
+		default:
+			counters.Denied += n
+		}
+	}
+	return counters
+}
@@ -0,0 +1,83 @@
+package ip_white
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// GeoInfo is where a client IP comes from, as resolved by a GeoLookup.
+type GeoInfo struct {
+	Country string `json:"country,omitempty"`
+	ASN     uint32 `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// GeoLookup resolves the country and ASN of an IP, e.g. a wrapper around a MaxMind GeoLite2
+// reader. The package only defines the interface: the database, its reader and their updates
+// are a dependency of the caller.
+type GeoLookup interface {
+	Lookup(ip net.IP) (GeoInfo, error)
+}
+
+type geoContextKey string
+
+func (k geoContextKey) String() string {
+	return string(k)
+}
+
+// GeoKey is the request context key holding the GeoInfo of allowed and rejected clients when
+// WithGeoLookup is set. Pass it to logger.WithContextValueKeys to get a "geo" access log field.
+const GeoKey geoContextKey = "geo"
+
+// GeoFromContext returns the GeoInfo the guard stored in the request context.
+func GeoFromContext(ctx context.Context) (GeoInfo, bool) {
+	geo, ok := ctx.Value(GeoKey).(GeoInfo)
+	return geo, ok
+}
+
+// geoCache remembers GeoLookup answers. Errors are never cached.
+type geoCache struct {
+	lookup GeoLookup
+	cache  *lruCache[GeoInfo]
+}
+
+func newGeoCache(lookup GeoLookup, ttl time.Duration, size int) *geoCache {
+	return &geoCache{lookup: lookup, cache: newLRUCache[GeoInfo](ttl, size)}
+}
+
+func (g *geoCache) resolve(ip net.IP) (GeoInfo, bool) {
+	key := ip.String()
+	now := time.Now()
+	if g.cache.ttl > 0 {
+		if geo, ok := g.cache.get(key, now); ok {
+			return geo, true
+		}
+	}
+	geo, err := g.lookup.Lookup(ip)
+	if err != nil {
+		return GeoInfo{}, false
+	}
+	if g.cache.ttl > 0 {
+		g.cache.add(key, geo, now)
+	}
+	return geo, true
+}
+
+// withGeo returns r with the GeoInfo of ip in its context, or r itself without WithGeoLookup
+// or when the lookup fails.
+func (g *Guard) withGeo(r *http.Request, ip string) *http.Request {
+	if g.geo == nil {
+		return r
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return r
+	}
+	geo, ok := g.geo.resolve(addr)
+	if !ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), GeoKey, geo))
+}
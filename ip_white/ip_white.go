@@ -1,47 +1,406 @@
 package ip_white
 
 import (
-	"github.com/gin-gonic/gin"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"net"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
-func New(opts ...Option) gin.HandlerFunc {
-	cfg := &option{}
+// Guard checks client IPs against a precompiled whitelist. The same Guard can protect
+// gin routes through Handler and plain net/http handlers through WrapHandler.
+type Guard struct {
+	cfg        *option
+	matcher    *matcher
+	ports      map[int]*matcher
+	source     *sourceCache
+	geo        *geoCache
+	userAgents map[string]struct{}
+	uaRegexes  []*regexp.Regexp
+	certs      map[string]struct{}
+	nat64      *net.IPNet
+	proxies    *matcher
+
+	mu   sync.RWMutex
+	bans map[string]time.Time
+	now  func() time.Time
+
+	counts      [ruleCount]atomic.Uint64
+	maintenance atomic.Pointer[matcher]
+	grants      atomic.Pointer[[]temporaryGrant]
+}
+
+// NewGuard returns a Guard built from the given options.
+func NewGuard(opts ...Option) *Guard {
+	cfg := &option{IPSourceCacheTTL: time.Minute, GeoCacheTTL: time.Hour, RedirectRequest: acceptsHTML}
 	for _, opt := range opts {
 		opt(cfg)
 	}
-	return func(c *gin.Context) {
-		if !isIPWhite(c.ClientIP(), cfg.WhiteList) {
-			c.AbortWithStatus(http.StatusForbidden)
-			return
+	g := &Guard{
+		cfg:     cfg,
+		matcher: newMatcher(cfg.WhiteList),
+		bans:    make(map[string]time.Time),
+		now:     time.Now,
+	}
+	g.grants.Store(newTemporaryGrants(cfg.TemporaryIPs))
+	if len(cfg.TrustedProxies) > 0 {
+		g.proxies = newMatcher(cfg.TrustedProxies)
+	}
+	if len(cfg.PortWhiteLists) > 0 {
+		g.ports = make(map[int]*matcher, len(cfg.PortWhiteLists))
+		for port, whitelist := range cfg.PortWhiteLists {
+			g.ports[port] = newMatcher(whitelist)
 		}
 	}
+	if cfg.IPSource != nil {
+		g.source = newSourceCache(cfg.IPSource, cfg.IPSourceCacheTTL, cfg.IPSourceCacheSize)
+	}
+	if cfg.GeoLookup != nil {
+		g.geo = newGeoCache(cfg.GeoLookup, cfg.GeoCacheTTL, cfg.IPSourceCacheSize)
+	}
+	if len(cfg.UserAgents) > 0 {
+		g.userAgents = make(map[string]struct{}, len(cfg.UserAgents))
+		for _, ua := range cfg.UserAgents {
+			g.userAgents[ua] = struct{}{}
+		}
+	}
+	for _, pattern := range cfg.UserAgentRegexes {
+		g.uaRegexes = append(g.uaRegexes, regexp.MustCompile(pattern))
+	}
+	if cfg.NAT64Prefix != "" {
+		prefix, err := parseNAT64Prefix(cfg.NAT64Prefix)
+		if err != nil {
+			panic(err.Error())
+		}
+		g.nat64 = prefix
+	}
+	if len(cfg.CertFingerprints) > 0 {
+		g.certs = make(map[string]struct{}, len(cfg.CertFingerprints))
+		for _, fp := range cfg.CertFingerprints {
+			g.certs[normalizeFingerprint(fp)] = struct{}{}
+		}
+	}
+	return g
 }
 
-func isIPWhite(ip string, whitelist []string) bool {
-	ipAddr := net.ParseIP(ip)
-	if ipAddr == nil {
-		return false
+func parseNAT64Prefix(prefix string) (*net.IPNet, error) {
+	_, ipNet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if ones, bits := ipNet.Mask.Size(); ones != 96 || bits != 128 {
+		return nil, errors.New("ip_white: NAT64 prefix must be an IPv6 /96")
 	}
+	return ipNet, nil
+}
+
+// New returns a gin middleware rejecting clients outside the whitelist with 403.
+func New(opts ...Option) gin.HandlerFunc {
+	return NewGuard(opts...).Handler()
+}
 
-	for _, allowedIP := range whitelist {
-		if strings.Contains(allowedIP, "/") {
-			_, ipNet, err := net.ParseCIDR(allowedIP)
-			if err != nil {
-				continue
+// Handler returns the gin middleware of the guard.
+func (g *Guard) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip, ok := g.signedIP(c.Request)
+		if !ok {
+			ip = c.ClientIP()
+		}
+		c.Request = g.withGeo(c.Request, ip)
+		if active, allowed := g.maintenanceAllows(ip); active {
+			if !allowed {
+				c.Abort()
+				c.String(http.StatusServiceUnavailable, maintenanceBody)
+			}
+			return
+		}
+		allowed, loose := g.allowRequest(c.Request, ip)
+		if !allowed {
+			if g.redirect(c.Request) {
+				c.Abort()
+				c.Redirect(http.StatusFound, g.cfg.RejectRedirectURL)
+				return
 			}
-			if ipNet.Contains(ipAddr) {
-				return true
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		if loose && !g.limitBody(c.Writer, c.Request) {
+			c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+}
+
+// WrapHandler protects a net/http handler with the guard. The client IP is taken from
+// the headers set by WithClientIPHeaders, when sent by WithTrustedProxies, falling back to
+// r.RemoteAddr.
+func (g *Guard) WrapHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := g.requestIP(r)
+		r = g.withGeo(r, ip)
+		if active, allowed := g.maintenanceAllows(ip); active {
+			if !allowed {
+				http.Error(w, maintenanceBody, http.StatusServiceUnavailable)
+				return
 			}
-		} else {
-			allowedIP = strings.TrimSpace(allowedIP)
-			if allowedIP == ip {
-				return true
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed, loose := g.allowRequest(r, ip)
+		if !allowed {
+			if g.redirect(r) {
+				http.Redirect(w, r, g.cfg.RejectRedirectURL, http.StatusFound)
+				return
 			}
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if loose && !g.limitBody(w, r) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
 		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// WrapHandlerFunc is the http.HandlerFunc flavour of WrapHandler.
+func (g *Guard) WrapHandlerFunc(next http.HandlerFunc) http.HandlerFunc {
+	return g.WrapHandler(next).ServeHTTP
+}
+
+// redirect reports whether a rejected request is sent to WithRedirectOnReject.
+func (g *Guard) redirect(r *http.Request) bool {
+	return g.cfg.RejectRedirectURL != "" && g.cfg.RedirectRequest != nil && g.cfg.RedirectRequest(r)
+}
+
+// allowRequest rejects banned IPs, then checks the User-Agent and client certificate
+// rules before the IP rules. loose reports a request let through only by the User-Agent
+// rule or by FailOpen, without its IP being whitelisted.
+func (g *Guard) allowRequest(r *http.Request, ip string) (allowed, loose bool) {
+	decision := g.decideRequest(r, ip, &loose)
+	g.counts[decision].Add(1)
+	return decision.allowed(), loose
+}
+
+func (g *Guard) decideRequest(r *http.Request, ip string, loose *bool) rule {
+	if g.banned(net.ParseIP(ip)) {
+		return ruleBanned
+	}
+	if g.allowedUserAgent(r.UserAgent()) {
+		if g.cfg.Logger != nil {
+			g.cfg.Logger.Infof("allowed by user agent: ip=%s path=%s", ip, r.URL.Path)
+		}
+		if g.cfg.MaxBodyNonWhitelisted > 0 {
+			ipRule := g.decide(ip)
+			*loose = !ipRule.allowed() || ipRule == ruleFailOpen
+		}
+		return ruleUserAgent
+	}
+	if g.allowedClientCert(r.TLS) {
+		return ruleClientCert
+	}
+	if g.portAllows(r, ip) {
+		return rulePort
+	}
+	decision := g.decide(ip)
+	*loose = decision == ruleFailOpen
+	return decision
+}
+
+// portAllows reports whether ip is on the WithPortIpWhite list of the local port r came in on.
+func (g *Guard) portAllows(r *http.Request, ip string) bool {
+	if g.ports == nil {
+		return false
+	}
+	port, ok := localPort(r)
+	if !ok {
+		return false
+	}
+	m, ok := g.ports[port]
+	if !ok {
+		return false
+	}
+	addr := net.ParseIP(ip)
+	if m.contains(addr) {
+		return true
+	}
+	mapped, ok := g.nat64IPv4(addr)
+	return ok && m.contains(mapped)
+}
+
+// localPort returns the port of the listener that accepted r, which net/http stores in the
+// request context under http.LocalAddrContextKey.
+func localPort(r *http.Request) (int, bool) {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return 0, false
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(port)
+	return n, err == nil
+}
+
+// limitBody caps the body of a loosely allowed request at MaxBodyNonWhitelisted. It returns
+// false when the declared Content-Length already exceeds the cap.
+func (g *Guard) limitBody(w http.ResponseWriter, r *http.Request) bool {
+	limit := g.cfg.MaxBodyNonWhitelisted
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if r.ContentLength > limit {
+		return false
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
 
+// allowedClientCert checks the SHA-256 fingerprint of a verified mTLS leaf certificate.
+func (g *Guard) allowedClientCert(state *tls.ConnectionState) bool {
+	if len(g.certs) == 0 || state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return false
+	}
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	_, ok := g.certs[hex.EncodeToString(sum[:])]
+	return ok
+}
+
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fp), ":", ""))
+}
+
+func (g *Guard) allowedUserAgent(ua string) bool {
+	if ua == "" {
+		return false
+	}
+	if _, ok := g.userAgents[ua]; ok {
+		return true
+	}
+	for _, re := range g.uaRegexes {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
 	return false
 }
+
+// Allowed reports whether ip is not banned and is on the whitelist or accepted by the IPSource.
+func (g *Guard) Allowed(ip string) bool {
+	return g.decide(ip).allowed()
+}
+
+// decide returns the IP rule matching ip.
+func (g *Guard) decide(ip string) rule {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ruleNotListed
+	}
+	if g.banned(addr) {
+		return ruleBanned
+	}
+	if g.matcher.contains(addr) {
+		return ruleWhitelist
+	}
+	if g.temporaryAllows(addr) {
+		return ruleTemporary
+	}
+	if mapped, ok := g.nat64IPv4(addr); ok {
+		addr = mapped
+		if g.matcher.contains(addr) {
+			return ruleNAT64
+		}
+		if g.temporaryAllows(addr) {
+			return ruleTemporary
+		}
+	}
+	if g.source == nil {
+		return ruleNotListed
+	}
+	allowed, err := g.source.allowed(addr, g.now())
+	if err != nil {
+		if g.cfg.FailOpen {
+			return ruleFailOpen
+		}
+		return ruleNotListed
+	}
+	if allowed {
+		return ruleSource
+	}
+	return ruleNotListed
+}
+
+// nat64IPv4 returns the IPv4 address embedded in addr when addr is inside the WithNAT64Prefix
+// prefix.
+func (g *Guard) nat64IPv4(addr net.IP) (net.IP, bool) {
+	if g.nat64 == nil || addr == nil || addr.To4() != nil || !g.nat64.Contains(addr) {
+		return nil, false
+	}
+	// RFC 6052: the IPv4 address is carried in the last 32 bits of a /96 prefix.
+	return net.IPv4(addr[12], addr[13], addr[14], addr[15]), true
+}
+
+// signedIP returns the client IP vouched for by WithSignedClientIP.
+func (g *Guard) signedIP(r *http.Request) (string, bool) {
+	if g.cfg.SignedClientIP == nil {
+		return "", false
+	}
+	ip, ok := g.cfg.SignedClientIP(r.Header)
+	if !ok || ip == nil {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// requestIP returns the client IP for WrapHandler: the signed IP, then the first
+// WithClientIPHeaders header holding one, when r comes from a trusted proxy, then r.RemoteAddr.
+func (g *Guard) requestIP(r *http.Request) string {
+	if ip, ok := g.signedIP(r); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if g.proxies != nil && !g.proxies.contains(net.ParseIP(host)) {
+		return host
+	}
+	for _, header := range g.cfg.ClientIPHeaders {
+		if ip, ok := g.forwardedIP(strings.Join(r.Header.Values(header), ",")); ok {
+			return ip
+		}
+	}
+	return host
+}
+
+// forwardedIP walks an X-Forwarded-For style list from the nearest hop and returns the first
+// one that is not a trusted proxy. Proxies append to the list, so only its right end is
+// trustworthy: whatever the client sent comes first.
+func (g *Guard) forwardedIP(value string) (string, bool) {
+	if value == "" {
+		return "", false
+	}
+	hops := strings.Split(value, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			return "", false
+		}
+		if i == 0 || g.proxies == nil || !g.proxies.contains(ip) {
+			return hop, true
+		}
+	}
+	return "", false
+}
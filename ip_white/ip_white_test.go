@@ -0,0 +1,664 @@
+package ip_white
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func performRequest(r http.Handler, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func newTestRouter(opts ...Option) *gin.Engine {
+	router := gin.New()
+	router.Use(New(opts...))
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	return router
+}
+
+func TestMatcher(t *testing.T) {
+	m := newMatcher([]string{"10.0.0.0/8", " 192.168.1.1 ", "bad", "1.2.3.4/99"})
+	assert.Nil(t, m.single)
+	assert.True(t, m.contains(net.ParseIP("10.20.30.40")))
+	assert.True(t, m.contains(net.ParseIP("192.168.1.1")))
+	assert.False(t, m.contains(net.ParseIP("192.168.1.2")))
+	assert.False(t, m.contains(nil))
+
+	m = newMatcher([]string{"10.0.0.0/8"})
+	assert.NotNil(t, m.single)
+	assert.True(t, m.contains(net.ParseIP("10.1.2.3")))
+	assert.False(t, m.contains(net.ParseIP("11.1.2.3")))
+}
+
+func TestNew(t *testing.T) {
+	router := newTestRouter(WithIpWhite([]string{"10.0.0.0/8"}))
+
+	w := performRequest(router, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = performRequest(router, "11.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestWrapHandler(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	xff := func(value string) http.Header { return http.Header{"X-Forwarded-For": {value}} }
+
+	handler := NewGuard(WithIpWhite([]string{"10.0.0.0/8"})).WrapHandler(ok)
+	assert.Equal(t, http.StatusOK, performRequest(handler, "10.0.0.1:1234", nil).Code)
+	assert.Equal(t, http.StatusForbidden, performRequest(handler, "192.0.2.1:1234", nil).Code)
+	// headers are ignored unless WithClientIPHeaders is set
+	assert.Equal(t, http.StatusForbidden, performRequest(handler, "192.0.2.1:1234", xff("10.0.0.1")).Code)
+
+	// behind an appending proxy only the hop it added is used, not what the client sent
+	handler = NewGuard(WithIpWhite([]string{"10.0.0.0/8"}), WithClientIPHeaders([]string{"X-Forwarded-For"})).WrapHandler(ok)
+	assert.Equal(t, http.StatusOK, performRequest(handler, "172.16.0.1:1234", xff("10.0.0.1")).Code)
+	assert.Equal(t, http.StatusForbidden, performRequest(handler, "172.16.0.1:1234", xff("10.0.0.1, 192.0.2.1")).Code)
+	assert.Equal(t, http.StatusForbidden, performRequest(handler, "172.16.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.1", "192.0.2.1"}}).Code)
+	assert.Equal(t, http.StatusOK, performRequest(handler, "10.0.0.1:1234", xff("bad")).Code)
+
+	// trusted proxies are skipped, and only they may set the header
+	handler = NewGuard(
+		WithIpWhite([]string{"10.0.0.0/8"}),
+		WithClientIPHeaders([]string{"X-Forwarded-For"}),
+		WithTrustedProxies([]string{"172.16.0.0/12"}),
+	).WrapHandler(ok)
+	assert.Equal(t, http.StatusOK, performRequest(handler, "172.16.0.1:1234", xff("10.0.0.1, 172.16.0.2")).Code)
+	assert.Equal(t, http.StatusForbidden, performRequest(handler, "172.16.0.1:1234", xff("10.0.0.1, 192.0.2.1, 172.16.0.2")).Code)
+	assert.Equal(t, http.StatusForbidden, performRequest(handler, "192.0.2.1:1234", xff("10.0.0.1")).Code)
+
+	// WrapHandler and Handler agree for the same proxy setup
+	router := gin.New()
+	assert.NoError(t, router.SetTrustedProxies([]string{"172.16.0.0/12"}))
+	router.Use(New(WithIpWhite([]string{"10.0.0.0/8"})))
+	router.GET("/", func(c *gin.Context) {})
+	for _, value := range []string{"10.0.0.1, 172.16.0.2", "10.0.0.1, 192.0.2.1, 172.16.0.2"} {
+		assert.Equal(t, performRequest(router, "172.16.0.1:1234", xff(value)).Code, performRequest(handler, "172.16.0.1:1234", xff(value)).Code, value)
+	}
+
+	assert.Error(t, Validate(WithTrustedProxies([]string{"bad"})))
+}
+
+func benchmarkMatcher(b *testing.B, whitelist []string) {
+	m := newMatcher(whitelist)
+	ip := net.ParseIP("10.200.3.4")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.contains(ip)
+	}
+}
+
+func BenchmarkMatcherSingleCIDR(b *testing.B) {
+	benchmarkMatcher(b, []string{"10.200.0.0/16"})
+}
+
+func BenchmarkMatcherMultiEntry(b *testing.B) {
+	benchmarkMatcher(b, []string{"192.168.0.1", "172.16.0.1", "172.16.0.0/12", "192.168.0.0/16", "10.200.0.0/16"})
+}
+
+func TestAllowClientCertFingerprints(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("client certificate")}
+	sum := sha256.Sum256(cert.Raw)
+	fp := strings.ToUpper(hex.EncodeToString(sum[:2])) + ":" + hex.EncodeToString(sum[2:])
+
+	g := NewGuard(WithIpWhite([]string{"10.0.0.0/8"}), WithAllowClientCertFingerprints([]string{fp}))
+	handler := g.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "11.0.0.1:1234"
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// unverified peer certificates are ignored
+	req.TLS.VerifiedChains = nil
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// non mTLS requests fall through to the IP check
+	req.TLS = nil
+	req.RemoteAddr = "10.0.0.1:1234"
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestNAT64Prefix(t *testing.T) {
+	g := NewGuard(WithIpWhite([]string{"192.0.2.0/24", "198.51.100.7"}), WithNAT64Prefix("64:ff9b::/96"))
+	assert.True(t, g.Allowed("64:ff9b::192.0.2.33"))
+	assert.True(t, g.Allowed("64:ff9b::c633:6407")) // 198.51.100.7
+	assert.False(t, g.Allowed("64:ff9b::203.0.113.1"))
+	assert.True(t, g.Allowed("192.0.2.1"))
+
+	// outside the prefix nothing is extracted
+	assert.False(t, g.Allowed("2001:db8::192.0.2.33"))
+
+	// without the option the embedded address is ignored
+	g = NewGuard(WithIpWhite([]string{"192.0.2.0/24"}))
+	assert.False(t, g.Allowed("64:ff9b::192.0.2.33"))
+
+	// IPv6 entries still match the untranslated address
+	g = NewGuard(WithIpWhite([]string{"64:ff9b::/96"}), WithNAT64Prefix("64:ff9b::/96"))
+	assert.True(t, g.Allowed("64:ff9b::203.0.113.1"))
+
+	assert.Panics(t, func() { NewGuard(WithNAT64Prefix("64:ff9b::/64")) })
+	assert.Panics(t, func() { NewGuard(WithNAT64Prefix("bad")) })
+}
+
+func TestBanIP(t *testing.T) {
+	now := time.Now()
+	g := NewGuard(WithIpWhite([]string{"10.0.0.0/8"}), WithAllowUserAgents([]string{"probe"}))
+	g.now = func() time.Time { return now }
+	handler := g.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	assert.Error(t, g.BanIP("bad", time.Minute))
+	assert.NoError(t, g.BanIP("10.0.0.1", time.Minute))
+	assert.False(t, g.Allowed("10.0.0.1"))
+	assert.True(t, g.Allowed("10.0.0.2"))
+
+	// bans take precedence over every allow rule
+	w := performRequest(handler, "10.0.0.1:1234", http.Header{"User-Agent": []string{"probe"}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// the ban expires
+	now = now.Add(time.Minute)
+	assert.True(t, g.Allowed("10.0.0.1"))
+	assert.Empty(t, g.bans)
+
+	// and can be lifted early
+	assert.NoError(t, g.BanIP("10.0.0.1", time.Hour))
+	g.UnbanIP("10.0.0.1")
+	assert.True(t, g.Allowed("10.0.0.1"))
+
+	// expired bans are pruned when new ones are added
+	assert.NoError(t, g.BanIP("10.0.0.3", time.Second))
+	now = now.Add(2 * time.Second)
+	assert.NoError(t, g.BanIP("10.0.0.4", time.Second))
+	assert.Len(t, g.bans, 1)
+}
+
+func TestBanIPNAT64(t *testing.T) {
+	g := NewGuard(WithIpWhite([]string{"192.0.2.5"}), WithNAT64Prefix("64:ff9b::/96"))
+	handler := g.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	assert.True(t, g.Allowed("64:ff9b::c000:205"))
+
+	// a ban on the IPv4 address also covers its NAT64 form
+	assert.NoError(t, g.BanIP("192.0.2.5", time.Minute))
+	assert.False(t, g.Allowed("192.0.2.5"))
+	assert.False(t, g.Allowed("64:ff9b::c000:205"))
+	w := performRequest(handler, "[64:ff9b::c000:205]:1234", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	g.UnbanIP("192.0.2.5")
+	assert.True(t, g.Allowed("64:ff9b::c000:205"))
+}
+
+func TestMaxBodyForNonWhitelisted(t *testing.T) {
+	router := gin.New()
+	router.Use(New(
+		WithIpWhite([]string{"10.0.0.0/8"}),
+		WithAllowUserAgents([]string{"deploy-bot"}),
+		WithMaxBodyForNonWhitelisted(4),
+	))
+	router.POST("/", func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.Status(http.StatusRequestEntityTooLarge)
+			return
+		}
+		c.String(http.StatusOK, string(body))
+	})
+	post := func(remoteAddr, body string, contentLength int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		req.ContentLength = contentLength
+		req.Header.Set("User-Agent", "deploy-bot")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("10.0.0.1:1234", "large body", 10)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "large body", w.Body.String())
+
+	w = post("11.0.0.1:1234", "tiny", 4)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = post("11.0.0.1:1234", "large body", 10)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = post("11.0.0.1:1234", "large body", -1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+// geoSource stands in for a GeoIP lookup, allowing the 10.0.0.0/8 "country".
+type geoSource struct {
+	lookups atomic.Int64
+	cost    time.Duration
+}
+
+func (s *geoSource) Allowed(ip net.IP) (bool, error) {
+	s.lookups.Add(1)
+	if s.cost > 0 {
+		time.Sleep(s.cost)
+	}
+	return ip.To4() != nil && ip.To4()[0] == 10, nil
+}
+
+func TestIPSourceCache(t *testing.T) {
+	source := &geoSource{}
+	g := NewGuard(WithIPSource(source), WithIPSourceCacheSize(2))
+
+	assert.True(t, g.Allowed("10.0.0.1"))
+	assert.True(t, g.Allowed("10.0.0.1"))
+	assert.False(t, g.Allowed("11.0.0.1"))
+	assert.Equal(t, int64(2), source.lookups.Load())
+
+	// 10.0.0.1 was used last, 11.0.0.1 is evicted
+	assert.True(t, g.Allowed("10.0.0.1"))
+	assert.True(t, g.Allowed("10.0.0.2"))
+	assert.False(t, g.Allowed("11.0.0.1"))
+	assert.Equal(t, int64(4), source.lookups.Load())
+
+	g.InvalidateCache()
+	assert.False(t, g.Allowed("11.0.0.1"))
+	assert.Equal(t, int64(5), source.lookups.Load())
+}
+
+type stubSource struct {
+	allowed map[string]bool
+	err     error
+	lookups int
+}
+
+func (s *stubSource) Allowed(ip net.IP) (bool, error) {
+	s.lookups++
+	return s.allowed[ip.String()], s.err
+}
+
+func TestIPSource(t *testing.T) {
+	now := time.Now()
+	source := &stubSource{allowed: map[string]bool{"192.0.2.1": true}}
+	g := NewGuard(WithIpWhite([]string{"10.0.0.0/8"}), WithIPSource(source), WithIPSourceCacheTTL(time.Minute))
+	g.now = func() time.Time { return now }
+	handler := g.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// the source is only asked when the whitelist misses
+	assert.True(t, g.Allowed("10.0.0.1"))
+	assert.Equal(t, 0, source.lookups)
+	assert.Equal(t, http.StatusOK, performRequest(handler, "192.0.2.1:1234", nil).Code)
+	assert.Equal(t, http.StatusForbidden, performRequest(handler, "192.0.2.2:1234", nil).Code)
+	assert.Equal(t, uint64(1), g.Counters().ByRule["ip_source"])
+	assert.Equal(t, 2, source.lookups)
+
+	// answers are cached until the TTL
+	source.allowed = map[string]bool{"192.0.2.2": true}
+	now = now.Add(time.Minute - time.Nanosecond)
+	assert.True(t, g.Allowed("192.0.2.1"))
+	assert.False(t, g.Allowed("192.0.2.2"))
+	assert.Equal(t, 2, source.lookups)
+	now = now.Add(time.Nanosecond)
+	assert.False(t, g.Allowed("192.0.2.1"))
+	assert.Equal(t, 3, source.lookups)
+
+	// or until the cache is invalidated
+	g.InvalidateCache()
+	assert.True(t, g.Allowed("192.0.2.2"))
+	assert.Equal(t, 4, source.lookups)
+
+	// errors are never cached, and reject the request unless WithFailOpen
+	source.err = errors.New("source down")
+	assert.False(t, g.Allowed("192.0.2.3"))
+	assert.False(t, g.Allowed("192.0.2.3"))
+	assert.Equal(t, 6, source.lookups)
+	assert.True(t, g.Allowed("10.0.0.1"))
+
+	source = &stubSource{err: errors.New("source down")}
+	g = NewGuard(WithIpWhite([]string{"10.0.0.0/8"}), WithIPSource(source), WithFailOpen(true))
+	handler = g.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	assert.True(t, g.Allowed("192.0.2.3"))
+	assert.Equal(t, http.StatusOK, performRequest(handler, "192.0.2.3:1234", nil).Code)
+	assert.Equal(t, uint64(1), g.Counters().ByRule["fail_open"])
+	// a source answering no is still a rejection
+	source.err = nil
+	g.InvalidateCache()
+	assert.False(t, g.Allowed("192.0.2.3"))
+}
+
+func benchmarkGeoSource(b *testing.B, ttl time.Duration) {
+	g := NewGuard(WithIPSource(&geoSource{cost: 20 * time.Microsecond}), WithIPSourceCacheTTL(ttl))
+	ips := []string{"10.0.0.1", "10.0.0.2", "11.0.0.1", "11.0.0.2"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.Allowed(ips[i%len(ips)])
+	}
+}
+
+func BenchmarkGeoSourceUncached(b *testing.B) {
+	benchmarkGeoSource(b, 0)
+}
+
+func BenchmarkGeoSourceCached(b *testing.B) {
+	benchmarkGeoSource(b, time.Minute)
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, Validate(WithIpWhite([]string{"10.0.0.0/8", "192.168.1.1", "2001:DB8::/32"})))
+
+	err := Validate(
+		WithIpWhite([]string{"10.0.0.0/8", "10.1.0.0/16", "10.2.3.4", " 10.0.0.0/8", "bad", "172.16.0.1/12"}),
+		WithAllowUserAgentRegexes([]string{"(unclosed"}),
+		WithAllowClientCertFingerprints([]string{"AB:CD"}),
+		WithNAT64Prefix("64:ff9b::/64"),
+	)
+	assert.Error(t, err)
+	lines := strings.Split(err.Error(), "\n")
+	assert.Equal(t, []string{
+		`whitelist entry " 10.0.0.0/8" duplicates "10.0.0.0/8"`,
+		`whitelist entry "bad" is ignored: invalid IP address "bad"`,
+		`whitelist entry "172.16.0.1/12" has host bits set, it matches 172.16.0.0/12`,
+		`whitelist entry "10.1.0.0/16" is already covered by "10.0.0.0/8"`,
+		`whitelist entry "10.2.3.4" is already covered by "10.0.0.0/8"`,
+		"user agent regex \"(unclosed\": error parsing regexp: missing closing ): `(unclosed`",
+		`client certificate fingerprint "AB:CD": not a hex SHA-256 digest`,
+		`NAT64 prefix "64:ff9b::/64": ip_white: NAT64 prefix must be an IPv6 /96`,
+	}, lines)
+}
+
+func TestSetMaintenanceMode(t *testing.T) {
+	g := NewGuard(WithIpWhite([]string{"10.0.0.0/8"}), WithAllowUserAgents([]string{"deploy-bot"}))
+	router := gin.New()
+	router.Use(g.Handler())
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+	handler := g.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	g.SetMaintenanceMode(true, []string{"192.168.100.0/24"})
+	w := performRequest(router, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, maintenanceBody, w.Body.String())
+	w = performRequest(router, "11.0.0.1:1234", http.Header{"User-Agent": {"deploy-bot"}})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	w = performRequest(router, "192.168.100.7:1234", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(handler, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	w = performRequest(handler, "192.168.100.7:1234", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	assert.NoError(t, g.BanIP("192.168.100.7", time.Minute))
+	w = performRequest(router, "192.168.100.7:1234", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	g.UnbanIP("192.168.100.7")
+
+	g.SetMaintenanceMode(false, nil)
+	w = performRequest(router, "10.0.0.1:1234", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(router, "192.168.100.7:1234", nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	counters := g.Counters()
+	assert.Equal(t, uint64(2), counters.ByRule["maintenance"])
+	assert.Equal(t, uint64(3), counters.ByRule["maintenance_denied"])
+}
+
+func TestSummarize(t *testing.T) {
+	g := NewGuard(WithIpWhite([]string{
+		"10.0.0.0/8", "10.1.0.0/16", "10.1.2.3",
+		"192.168.0.0/25", "192.168.0.128/25", "192.168.1.1",
+		"2001:db8::/64", "2001:db8::1",
+	}))
+	report := g.Summarize()
+	assert.Equal(t, 8, report.Entries)
+	assert.Equal(t, uint64(1<<24+256+1), report.IPv4Addresses)
+	assert.Equal(t, new(big.Int).Lsh(big.NewInt(1), 64), report.IPv6Addresses)
+	assert.Equal(t, []string{
+		"10.1.0.0/16 is inside 10.0.0.0/8",
+		"10.1.2.3/32 is inside 10.0.0.0/8",
+		"2001:db8::1/128 is inside 2001:db8::/64",
+	}, report.Overlaps)
+	assert.Equal(t, []string{"192.168.0.0/25 + 192.168.0.128/25 = 192.168.0.0/24"}, report.Mergeable)
+}
+
+type countryLookup struct {
+	lookups atomic.Int64
+}
+
+func (l *countryLookup) Lookup(ip net.IP) (GeoInfo, error) {
+	l.lookups.Add(1)
+	if ip.To4() == nil {
+		return GeoInfo{}, errors.New("no IPv6 data")
+	}
+	if ip.To4()[0] == 10 {
+		return GeoInfo{Country: "FR", ASN: 64500, ASOrg: "Example SAS"}, nil
+	}
+	return GeoInfo{Country: "US", ASN: 64501}, nil
+}
+
+func TestGeoLookup(t *testing.T) {
+	lookup := &countryLookup{}
+	var geos []GeoInfo
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Next()
+		geo, _ := GeoFromContext(c.Request.Context())
+		geos = append(geos, geo)
+	})
+	router.Use(New(WithIpWhite([]string{"10.0.0.0/8"}), WithGeoLookup(lookup)))
+	router.GET("/", func(c *gin.Context) {})
+
+	assert.Equal(t, http.StatusOK, performRequest(router, "10.0.0.1:1234", nil).Code)
+	assert.Equal(t, http.StatusForbidden, performRequest(router, "11.0.0.1:1234", nil).Code)
+	assert.Equal(t, http.StatusOK, performRequest(router, "10.0.0.1:1234", nil).Code)
+	assert.Equal(t, http.StatusForbidden, performRequest(router, "[2001:db8::1]:1234", nil).Code)
+	assert.Equal(t, []GeoInfo{
+		{Country: "FR", ASN: 64500, ASOrg: "Example SAS"},
+		{Country: "US", ASN: 64501},
+		{Country: "FR", ASN: 64500, ASOrg: "Example SAS"},
+		{},
+	}, geos)
+	assert.Equal(t, int64(3), lookup.lookups.Load())
+
+	var got GeoInfo
+	g := NewGuard(WithIpWhite([]string{"10.0.0.0/8"}), WithGeoLookup(lookup), WithGeoCacheTTL(0))
+	handler := g.WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = GeoFromContext(r.Context())
+	}))
+	performRequest(handler, "10.0.0.1:1234", nil)
+	performRequest(handler, "10.0.0.1:1234", nil)
+	assert.Equal(t, "FR", got.Country)
+	// no cache: every request is looked up
+	assert.Equal(t, int64(5), lookup.lookups.Load())
+}
+
+func TestRedirectOnReject(t *testing.T) {
+	opts := []Option{WithIpWhite([]string{"10.0.0.0/8"}), WithRedirectOnReject("https://vpn.example.com/help")}
+	browser := http.Header{"Accept": {"text/html,application/xhtml+xml"}}
+	api := http.Header{"Accept": {"application/json"}}
+
+	router := newTestRouter(opts...)
+	w := performRequest(router, "11.0.0.1:1234", browser)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://vpn.example.com/help", w.Header().Get("Location"))
+	assert.Equal(t, http.StatusForbidden, performRequest(router, "11.0.0.1:1234", api).Code)
+	assert.Equal(t, http.StatusOK, performRequest(router, "10.0.0.1:1234", browser).Code)
+
+	handler := NewGuard(opts...).WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w = performRequest(handler, "11.0.0.1:1234", browser)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://vpn.example.com/help", w.Header().Get("Location"))
+
+	router = newTestRouter(append(opts, WithRedirectRequest(func(r *http.Request) bool {
+		return r.Header.Get("X-Client") == "portal"
+	}))...)
+	assert.Equal(t, http.StatusForbidden, performRequest(router, "11.0.0.1:1234", browser).Code)
+	assert.Equal(t, http.StatusFound, performRequest(router, "11.0.0.1:1234", http.Header{"X-Client": {"portal"}}).Code)
+}
+
+func TestSignedClientIP(t *testing.T) {
+	key := []byte("gateway-secret")
+	sign := func(ip string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(ip))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	verify := func(headers http.Header) (net.IP, bool) {
+		ip := headers.Get("X-Gateway-Client-IP")
+		if ip == "" || !hmac.Equal([]byte(sign(ip)), []byte(headers.Get("X-Gateway-Signature"))) {
+			return nil, false
+		}
+		return net.ParseIP(ip), true
+	}
+	opts := []Option{WithIpWhite([]string{"10.0.0.0/8"}), WithSignedClientIP(verify)}
+	signed := func(ip, signature string) http.Header {
+		return http.Header{"X-Gateway-Client-Ip": {ip}, "X-Gateway-Signature": {signature}}
+	}
+
+	router := newTestRouter(opts...)
+	assert.Equal(t, http.StatusOK, performRequest(router, "192.0.2.1:1234", signed("10.0.0.1", sign("10.0.0.1"))).Code)
+	assert.Equal(t, http.StatusForbidden, performRequest(router, "10.0.0.1:1234", signed("192.0.2.1", sign("192.0.2.1"))).Code)
+	// a forged signature falls back to c.ClientIP
+	assert.Equal(t, http.StatusForbidden, performRequest(router, "192.0.2.1:1234", signed("10.0.0.1", "forged")).Code)
+	assert.Equal(t, http.StatusOK, performRequest(router, "10.0.0.1:1234", nil).Code)
+
+	handler := NewGuard(append(opts, WithClientIPHeaders([]string{"X-Forwarded-For"}))...).WrapHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	assert.Equal(t, http.StatusOK, performRequest(handler, "192.0.2.1:1234", signed("10.0.0.1", sign("10.0.0.1"))).Code)
+	assert.Equal(t, http.StatusForbidden, performRequest(handler, "10.0.0.1:1234", signed("192.0.2.1", sign("192.0.2.1"))).Code)
+}
+
+func TestTemporaryIP(t *testing.T) {
+	now := time.Now()
+	until := now.Add(time.Hour)
+	g := NewGuard(
+		WithIpWhite([]string{"10.0.0.0/8"}),
+		WithTemporaryIP("192.0.2.7", until),
+		WithTemporaryIP("198.51.100.0/24", until.Add(time.Hour)),
+	)
+	g.now = func() time.Time { return now }
+	handler := g.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := performRequest(handler, "192.0.2.7:1234", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, uint64(1), g.Counters().ByRule["temporary"])
+	assert.True(t, g.Allowed("198.51.100.9"))
+	assert.False(t, g.Allowed("192.0.2.8"))
+
+	// honoured up to the deadline, which itself is excluded
+	now = until.Add(-time.Nanosecond)
+	assert.True(t, g.Allowed("192.0.2.7"))
+	now = until
+	assert.False(t, g.Allowed("192.0.2.7"))
+	assert.Len(t, *g.grants.Load(), 1)
+	assert.True(t, g.Allowed("198.51.100.9"))
+	assert.True(t, g.Allowed("10.0.0.1"))
+
+	now = until.Add(time.Hour)
+	assert.False(t, g.Allowed("198.51.100.9"))
+	assert.Nil(t, g.grants.Load())
+
+	assert.Error(t, Validate(WithTemporaryIP("bad", until)))
+}
+
+func TestTemporaryIPNAT64(t *testing.T) {
+	now := time.Now()
+	g := NewGuard(WithTemporaryIP("192.0.2.5", now.Add(time.Hour)), WithNAT64Prefix("64:ff9b::/96"))
+	g.now = func() time.Time { return now }
+	assert.True(t, g.Allowed("192.0.2.5"))
+	assert.True(t, g.Allowed("64:ff9b::c000:205"))
+	assert.False(t, g.Allowed("64:ff9b::c000:206"))
+
+	now = now.Add(time.Hour)
+	assert.False(t, g.Allowed("64:ff9b::c000:205"))
+}
+
+func TestTemporaryIPConcurrentExpiry(t *testing.T) {
+	start := time.Now()
+	var offset atomic.Int64
+	g := NewGuard(WithTemporaryIP("192.0.2.7", start.Add(time.Second)), WithTemporaryIP("192.0.2.8", start.Add(time.Hour)))
+	g.now = func() time.Time { return start.Add(time.Duration(offset.Load())) }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				offset.Store(int64(j) * int64(10*time.Millisecond))
+				g.Allowed("192.0.2.7")
+				assert.True(t, g.Allowed("192.0.2.8"))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, *g.grants.Load(), 1)
+}
+
+func TestPortIpWhite(t *testing.T) {
+	router := newTestRouter(
+		WithIpWhite([]string{"10.0.0.0/8"}),
+		WithPortIpWhite(9090, []string{"192.168.0.0/16"}),
+		WithNAT64Prefix("64:ff9b::/96"),
+	)
+	request := func(remoteAddr string, localAddr net.Addr) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		if localAddr != nil {
+			req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, localAddr))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	admin := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9090}
+	public := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+
+	assert.Equal(t, http.StatusOK, request("192.168.1.5:1234", admin))
+	assert.Equal(t, http.StatusForbidden, request("192.168.1.5:1234", public))
+	assert.Equal(t, http.StatusForbidden, request("192.168.1.5:1234", nil))
+	// the global whitelist applies on every port
+	assert.Equal(t, http.StatusOK, request("10.1.2.3:1234", admin))
+	assert.Equal(t, http.StatusOK, request("10.1.2.3:1234", public))
+	assert.Equal(t, http.StatusForbidden, request("172.16.0.1:1234", admin))
+	// NAT64 clients are matched by their embedded IPv4 address, as for the global whitelist
+	assert.Equal(t, http.StatusOK, request("[64:ff9b::c0a8:105]:1234", admin))
+	assert.Equal(t, http.StatusForbidden, request("[64:ff9b::c0a8:105]:1234", public))
+	assert.Equal(t, http.StatusForbidden, request("[64:ff9b::ac10:1]:1234", admin))
+
+	assert.Error(t, Validate(WithPortIpWhite(9090, []string{"bad"})))
+}
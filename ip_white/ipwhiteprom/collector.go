@@ -0,0 +1,55 @@
+// Package ipwhiteprom exposes the ip_white Guard counters as a Prometheus collector. It lives
+// in its own package so that ip_white users who do not use Prometheus do not import it.
+package ipwhiteprom
+
+import (
+	"github.com/donetkit/contrib_gin_middleware/ip_white"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsDesc = prometheus.NewDesc(
+		"ip_white_requests_total",
+		"Requests checked by the IP whitelist, by decision.",
+		[]string{"decision"}, nil,
+	)
+	ruleRequestsDesc = prometheus.NewDesc(
+		"ip_white_rule_requests_total",
+		"Requests checked by the IP whitelist, by deciding rule.",
+		[]string{"rule"}, nil,
+	)
+)
+
+// Collector reads the counters of a Guard on every scrape.
+type Collector struct {
+	guard   *ip_white.Guard
+	perRule bool
+}
+
+// NewCollector returns a collector for guard, ready for prometheus.MustRegister. perRule adds
+// the ip_white_rule_requests_total series labelled by rule.
+func NewCollector(guard *ip_white.Guard, perRule bool) *Collector {
+	return &Collector{guard: guard, perRule: perRule}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- requestsDesc
+	if c.perRule {
+		ch <- ruleRequestsDesc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	counters := c.guard.Counters()
+	ch <- prometheus.MustNewConstMetric(requestsDesc, prometheus.CounterValue, float64(counters.Allowed), "allowed")
+	ch <- prometheus.MustNewConstMetric(requestsDesc, prometheus.CounterValue, float64(counters.Denied), "denied")
+	ch <- prometheus.MustNewConstMetric(requestsDesc, prometheus.CounterValue, float64(counters.Bypassed), "bypassed")
+	if !c.perRule {
+		return
+	}
+	for rule, n := range counters.ByRule {
+		ch <- prometheus.MustNewConstMetric(ruleRequestsDesc, prometheus.CounterValue, float64(n), rule)
+	}
+}
@@ -0,0 +1,60 @@
+package ipwhiteprom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/donetkit/contrib_gin_middleware/ip_white"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	guard := ip_white.NewGuard(
+		ip_white.WithIpWhite([]string{"10.0.0.0/8"}),
+		ip_white.WithAllowUserAgents([]string{"deploy-bot"}),
+	)
+	handler := guard.WrapHandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, req := range []struct{ addr, ua string }{
+		{"10.0.0.1:1", ""},
+		{"10.0.0.2:1", ""},
+		{"11.0.0.1:1", ""},
+		{"11.0.0.1:1", "deploy-bot"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = req.addr
+		r.Header.Set("User-Agent", req.ua)
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	expected := `
+# HELP ip_white_requests_total Requests checked by the IP whitelist, by decision.
+# TYPE ip_white_requests_total counter
+ip_white_requests_total{decision="allowed"} 2
+ip_white_requests_total{decision="bypassed"} 1
+ip_white_requests_total{decision="denied"} 1
+`
+	assert.NoError(t, testutil.CollectAndCompare(NewCollector(guard, false), strings.NewReader(expected)))
+
+	perRule := NewCollector(guard, true)
+	assert.Equal(t, 15, testutil.CollectAndCount(perRule))
+	expected = `
+# HELP ip_white_rule_requests_total Requests checked by the IP whitelist, by deciding rule.
+# TYPE ip_white_rule_requests_total counter
+ip_white_rule_requests_total{rule="banned"} 0
+ip_white_rule_requests_total{rule="client_cert"} 0
+ip_white_rule_requests_total{rule="fail_open"} 0
+ip_white_rule_requests_total{rule="ip_source"} 0
+ip_white_rule_requests_total{rule="maintenance"} 0
+ip_white_rule_requests_total{rule="maintenance_denied"} 0
+ip_white_rule_requests_total{rule="nat64"} 0
+ip_white_rule_requests_total{rule="not_listed"} 1
+ip_white_rule_requests_total{rule="port"} 0
+ip_white_rule_requests_total{rule="temporary"} 0
+ip_white_rule_requests_total{rule="user_agent"} 1
+ip_white_rule_requests_total{rule="whitelist"} 2
+`
+	assert.NoError(t, testutil.CollectAndCompare(perRule, strings.NewReader(expected), "ip_white_rule_requests_total"))
+}
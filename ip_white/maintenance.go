@@ -0,0 +1,37 @@
+package ip_white
+
+import "net"
+
+// maintenanceBody is the body of the 503 answered to clients outside the maintenance list.
+const maintenanceBody = "Service under maintenance, please retry later."
+
+// SetMaintenanceMode restricts access to allowedIPs (IPs or CIDRs) while enabled, whatever
+// the whitelist, User-Agent or certificate rules say. Other clients get a 503 with a
+// maintenance body, banned IPs stay rejected. Disabling restores the normal rules. It is safe
+// to call while requests are being served.
+func (g *Guard) SetMaintenanceMode(enabled bool, allowedIPs []string) {
+	if !enabled {
+		g.maintenance.Store(nil)
+		return
+	}
+	g.maintenance.Store(newMatcher(allowedIPs))
+}
+
+// maintenanceAllows reports whether maintenance mode is on and, if so, whether ip may pass.
+func (g *Guard) maintenanceAllows(ip string) (active, allowed bool) {
+	m := g.maintenance.Load()
+	if m == nil {
+		return false, false
+	}
+	addr := net.ParseIP(ip)
+	switch {
+	case g.banned(addr):
+		g.counts[ruleBanned].Add(1)
+	case m.contains(addr):
+		g.counts[ruleMaintenance].Add(1)
+		return true, true
+	default:
+		g.counts[ruleMaintenanceDenied].Add(1)
+	}
+	return true, false
+}
@@ -0,0 +1,71 @@
+package ip_white
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// matcher is the precompiled form of a whitelist shared by every middleware flavour.
+type matcher struct {
+	ips  []net.IP
+	nets []*net.IPNet
+	// single is set when the whitelist is exactly one CIDR, the common VPN subnet case.
+	single *net.IPNet
+}
+
+func newMatcher(whitelist []string) *matcher {
+	m := &matcher{}
+	for _, entry := range whitelist {
+		ip, ipNet, err := parseEntry(entry)
+		switch {
+		case err != nil:
+			continue
+		case ipNet != nil:
+			m.nets = append(m.nets, ipNet)
+		default:
+			m.ips = append(m.ips, ip)
+		}
+	}
+	if len(m.nets) == 1 && len(m.ips) == 0 {
+		m.single = m.nets[0]
+	}
+	return m
+}
+
+// parseEntry parses a whitelist entry, either a single IP or a CIDR.
+func parseEntry(entry string) (net.IP, *net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, ipNet, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("invalid IP address %q", entry)
+	}
+	return ip, nil, nil
+}
+
+func (m *matcher) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if m.single != nil {
+		return m.single.Contains(ip)
+	}
+	for _, allowedIP := range m.ips {
+		if allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	for _, ipNet := range m.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
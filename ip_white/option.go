@@ -1,11 +1,37 @@
 package ip_white
 
 import (
+	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/donetkit/contrib-log/glog"
 )
 
 type option struct {
-	WhiteList []string
+	WhiteList         []string
+	ClientIPHeaders   []string
+	TrustedProxies    []string
+	IPSource          IPSource
+	IPSourceCacheTTL  time.Duration
+	IPSourceCacheSize int
+	FailOpen          bool
+	UserAgents        []string
+	UserAgentRegexes  []string
+	Logger            glog.ILoggerEntry
+	CertFingerprints  []string
+	NAT64Prefix       string
+	GeoLookup         GeoLookup
+	GeoCacheTTL       time.Duration
+	RejectRedirectURL string
+	RedirectRequest   func(r *http.Request) bool
+	SignedClientIP    func(headers http.Header) (net.IP, bool)
+	TemporaryIPs      []temporaryEntry
+	PortWhiteLists    map[int][]string
+
+	MaxBodyNonWhitelisted int64
 	sync.Mutex
 }
 
@@ -17,6 +43,176 @@ func WithIpWhite(ips []string) Option {
 	}
 }
 
+// WithPortIpWhite add a whitelist honoured only for requests accepted on the given local port,
+// on top of WithIpWhite, e.g. to open an internal admin listener to more IPs than the public one
+// while sharing one Guard. The port is read from http.LocalAddrContextKey, which http.Server
+// sets on every request; requests without it only get the global rules
+func WithPortIpWhite(port int, ips []string) Option {
+	return func(o *option) {
+		if o.PortWhiteLists == nil {
+			o.PortWhiteLists = make(map[int][]string)
+		}
+		o.PortWhiteLists[port] = append(o.PortWhiteLists[port], ips...)
+	}
+}
+
+// WithTemporaryIP add a whitelist entry, an IP or a CIDR, honoured until the given time only,
+// e.g. for a vendor granted access for a few days. Expired entries are pruned on the next check.
+// It can be repeated for several entries
+func WithTemporaryIP(ip string, until time.Time) Option {
+	return func(o *option) {
+		o.TemporaryIPs = append(o.TemporaryIPs, temporaryEntry{entry: ip, until: until})
+	}
+}
+
+// WithClientIPHeaders set the headers WrapHandler reads the client IP from, in order,
+// e.g. "X-Real-IP", "X-Forwarded-For". Like gin's ClientIP, a list is read from its rightmost
+// hop, skipping WithTrustedProxies, so a value prepended by the client is never used
+func WithClientIPHeaders(headers []string) Option {
+	return func(o *option) {
+		o.ClientIPHeaders = headers
+	}
+}
+
+// WithTrustedProxies set the IPs and CIDRs of the proxies in front of WrapHandler. The
+// WithClientIPHeaders headers are only read from requests sent by one of them, and these
+// proxies are skipped when walking X-Forwarded-For. Without it only the hop appended by the
+// nearest proxy is trusted
+func WithTrustedProxies(proxies []string) Option {
+	return func(o *option) {
+		o.TrustedProxies = proxies
+	}
+}
+
+// WithSignedClientIP set a func verifying a header signed by a trusted gateway, e.g. an HMAC
+// over the client IP, and returning that IP. It is used instead of c.ClientIP, or instead of
+// WithClientIPHeaders for WrapHandler, so a spoofed X-Forwarded-For cannot pass the whitelist.
+// Requests with a missing or invalid signature fall back to the usual client IP
+func WithSignedClientIP(verify func(headers http.Header) (net.IP, bool)) Option {
+	return func(o *option) {
+		o.SignedClientIP = verify
+	}
+}
+
+// WithIPSource set an external allowlist consulted when the static whitelist misses.
+// Answers are cached for WithIPSourceCacheTTL, default one minute
+func WithIPSource(source IPSource) Option {
+	return func(o *option) {
+		o.IPSource = source
+	}
+}
+
+// WithIPSourceCacheTTL set how long IPSource answers are cached, 0 disables the cache
+func WithIPSourceCacheTTL(ttl time.Duration) Option {
+	return func(o *option) {
+		o.IPSourceCacheTTL = ttl
+	}
+}
+
+// WithIPSourceCacheSize set how many IPs the IPSource cache remembers before evicting the least
+// recently used one, default 10000
+func WithIPSourceCacheSize(size int) Option {
+	return func(o *option) {
+		o.IPSourceCacheSize = size
+	}
+}
+
+// WithFailOpen set whether requests are allowed when a lookup fails, default false
+func WithFailOpen(failOpen bool) Option {
+	return func(o *option) {
+		o.FailOpen = failOpen
+	}
+}
+
+// WithAllowUserAgents set User-Agents that are allowed whatever the client IP.
+// The User-Agent is trivially spoofable: only use a secret value and pair it with other controls
+func WithAllowUserAgents(userAgents []string) Option {
+	return func(o *option) {
+		o.UserAgents = userAgents
+	}
+}
+
+// WithAllowUserAgentRegexes set User-Agent regular expressions that are allowed whatever the client IP,
+// see WithAllowUserAgents. Invalid expressions panic when the guard is built
+func WithAllowUserAgentRegexes(patterns []string) Option {
+	return func(o *option) {
+		o.UserAgentRegexes = patterns
+	}
+}
+
+// WithAllowClientCertFingerprints set SHA-256 fingerprints (hex, colons optional) of client
+// certificates allowed whatever the client IP. Only verified mTLS peer certificates are considered
+func WithAllowClientCertFingerprints(fingerprints []string) Option {
+	return func(o *option) {
+		o.CertFingerprints = fingerprints
+	}
+}
+
+// WithNAT64Prefix set the /96 NAT64 prefix of an IPv6-only deployment, usually the well-known
+// "64:ff9b::/96". Clients inside it are also matched by the IPv4 address embedded in their
+// last 32 bits, so IPv4 whitelist entries keep working behind the translator
+func WithNAT64Prefix(prefix string) Option {
+	return func(o *option) {
+		o.NAT64Prefix = prefix
+	}
+}
+
+// WithMaxBodyForNonWhitelisted set the maximum body size, in bytes, of requests allowed only by
+// a looser rule (WithAllowUserAgents, or WithFailOpen on a lookup error) rather than the whitelist.
+// A larger Content-Length is rejected with 413, otherwise the body is wrapped in http.MaxBytesReader
+// and reading past the cap fails. Middleware reading the body before the guard is not limited,
+// and handlers must surface the read error themselves, e.g. c.ShouldBind returns it. 0 disables the cap
+func WithMaxBodyForNonWhitelisted(bytes int64) Option {
+	return func(o *option) {
+		o.MaxBodyNonWhitelisted = bytes
+	}
+}
+
+// WithGeoLookup set a GeoLookup resolving the country and ASN of every client, allowed or not,
+// into the request context under GeoKey. It runs on each request before the whitelist, so its
+// answers are cached for WithGeoCacheTTL, default one hour, in a cache of WithIPSourceCacheSize IPs.
+// Failed lookups are not cached and leave the context untouched
+func WithGeoLookup(lookup GeoLookup) Option {
+	return func(o *option) {
+		o.GeoLookup = lookup
+	}
+}
+
+// WithGeoCacheTTL set how long GeoLookup answers are cached, 0 disables the cache
+func WithGeoCacheTTL(ttl time.Duration) Option {
+	return func(o *option) {
+		o.GeoCacheTTL = ttl
+	}
+}
+
+// WithRedirectOnReject set a page, e.g. VPN instructions, rejected browser requests are
+// redirected to with a 302 instead of getting a 403. Which requests are redirected is decided
+// by WithRedirectRequest, by default those accepting text/html; API clients keep the 403
+func WithRedirectOnReject(url string) Option {
+	return func(o *option) {
+		o.RejectRedirectURL = url
+	}
+}
+
+// WithRedirectRequest set which rejected requests WithRedirectOnReject redirects
+func WithRedirectRequest(fn func(r *http.Request) bool) Option {
+	return func(o *option) {
+		o.RedirectRequest = fn
+	}
+}
+
+// acceptsHTML is the default of WithRedirectRequest.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// WithLogger set logger function
+func WithLogger(logger glog.ILogger) Option {
+	return func(o *option) {
+		o.Logger = logger.WithField("Gin-IP-White", "Gin-IP-White")
+	}
+}
+
 //type option struct {
 //	WhiteList []string
 //	*sync.Mutex
@@ -0,0 +1,115 @@
+package ip_white
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+)
+
+// IPSource is an external allowlist, e.g. backed by Consul, etcd or Redis, or an expensive
+// matcher such as a GeoIP or reverse DNS lookup. It is only consulted when the static
+// whitelist does not match.
+type IPSource interface {
+	Allowed(ip net.IP) (bool, error)
+}
+
+// defaultSourceCacheSize bounds the number of IPs remembered by sourceCache.
+const defaultSourceCacheSize = 10000
+
+type cacheEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// lruCache remembers values for ttl, evicting the least recently used key once size
+// entries are held.
+type lruCache[V any] struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newLRUCache[V any](ttl time.Duration, size int) *lruCache[V] {
+	if size <= 0 {
+		size = defaultSourceCacheSize
+	}
+	return &lruCache[V]{ttl: ttl, size: size, lru: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *lruCache[V]) get(key string, now time.Time) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry[V])
+		if now.Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			return entry.value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+func (c *lruCache[V]) add(key string, value V, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry[V])
+		entry.value, entry.expires = value, now.Add(c.ttl)
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry[V]{key: key, value: value, expires: now.Add(c.ttl)})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry[V]).key)
+	}
+}
+
+// purge forgets every cached value.
+func (c *lruCache[V]) purge() {
+	c.mu.Lock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.mu.Unlock()
+}
+
+// sourceCache remembers IPSource decisions. Errors are never cached.
+type sourceCache struct {
+	source IPSource
+	cache  *lruCache[bool]
+}
+
+func newSourceCache(source IPSource, ttl time.Duration, size int) *sourceCache {
+	return &sourceCache{source: source, cache: newLRUCache[bool](ttl, size)}
+}
+
+func (s *sourceCache) allowed(ip net.IP, now time.Time) (bool, error) {
+	if s.cache.ttl <= 0 {
+		return s.source.Allowed(ip)
+	}
+	key := ip.String()
+	if allowed, ok := s.cache.get(key, now); ok {
+		return allowed, nil
+	}
+	allowed, err := s.source.Allowed(ip)
+	if err != nil {
+		return false, err
+	}
+	s.cache.add(key, allowed, now)
+	return allowed, nil
+}
+
+// InvalidateCache drops the cached IPSource decisions. Call it after the list behind the
+// IPSource was reloaded so the new rules apply at once instead of after the cache TTL.
+func (g *Guard) InvalidateCache() {
+	if g.source != nil {
+		g.source.cache.purge()
+	}
+}
@@ -0,0 +1,98 @@
+package ip_white
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// Report describes the address space allowed by a whitelist, see Guard.Summarize.
+type Report struct {
+	// Entries is the number of valid whitelist entries.
+	Entries int
+	// IPv4Addresses and IPv6Addresses count the distinct addresses covered.
+	IPv4Addresses uint64
+	IPv6Addresses *big.Int
+	// Overlaps lists the entries contained in another one, e.g. "10.1.0.0/16 is inside 10.0.0.0/8".
+	Overlaps []string
+	// Mergeable lists sibling CIDRs that could be replaced by their parent, e.g.
+	// "10.0.0.0/25 + 10.0.0.128/25 = 10.0.0.0/24".
+	Mergeable []string
+}
+
+// Summarize reports the address space allowed by the whitelist of the guard, the entries
+// overlapping each other and the ones that could be merged. It reads the precompiled
+// matcher, which is never modified once built.
+func (g *Guard) Summarize() Report {
+	prefixes := g.matcher.prefixes()
+	report := Report{Entries: len(prefixes), IPv6Addresses: new(big.Int)}
+
+	// Shorter prefixes first so that a prefix is always visited after the ones containing it.
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Bits() != prefixes[j].Bits() {
+			return prefixes[i].Bits() < prefixes[j].Bits()
+		}
+		return prefixes[i].Addr().Less(prefixes[j].Addr())
+	})
+	var disjoint []netip.Prefix
+	for _, p := range prefixes {
+		inside := false
+		for _, wider := range disjoint {
+			if wider.Bits() <= p.Bits() && wider.Contains(p.Addr()) {
+				report.Overlaps = append(report.Overlaps, fmt.Sprintf("%s is inside %s", p, wider))
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			disjoint = append(disjoint, p)
+		}
+	}
+
+	siblings := make(map[netip.Prefix]netip.Prefix, len(disjoint))
+	for _, p := range disjoint {
+		size := new(big.Int).Lsh(big.NewInt(1), uint(p.Addr().BitLen()-p.Bits()))
+		if p.Addr().Is4() {
+			report.IPv4Addresses += size.Uint64()
+		} else {
+			report.IPv6Addresses.Add(report.IPv6Addresses, size)
+		}
+		if p.Bits() == 0 {
+			continue
+		}
+		parent, _ := p.Addr().Prefix(p.Bits() - 1)
+		if sibling, ok := siblings[parent]; ok {
+			report.Mergeable = append(report.Mergeable, fmt.Sprintf("%s + %s = %s", sibling, p, parent))
+			continue
+		}
+		siblings[parent] = p
+	}
+	return report
+}
+
+// prefixes returns the whitelist entries as prefixes, single IPs being /32 or /128.
+func (m *matcher) prefixes() []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(m.ips)+len(m.nets))
+	for _, ip := range m.ips {
+		if addr, ok := netip.AddrFromSlice(ip); ok {
+			addr = addr.Unmap()
+			out = append(out, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	for _, n := range m.nets {
+		out = append(out, netPrefix(n))
+	}
+	return out
+}
+
+func netPrefix(n *net.IPNet) netip.Prefix {
+	addr, _ := netip.AddrFromSlice(n.IP)
+	addr = addr.Unmap()
+	ones, bits := n.Mask.Size()
+	if addr.Is4() && bits == 128 {
+		ones -= 96
+	}
+	return netip.PrefixFrom(addr, ones)
+}
@@ -0,0 +1,60 @@
+package ip_white
+
+import (
+	"net"
+	"time"
+)
+
+// temporaryEntry is a whitelist entry, an IP or a CIDR, honoured until a deadline.
+type temporaryEntry struct {
+	entry string
+	until time.Time
+}
+
+type temporaryGrant struct {
+	matcher *matcher
+	until   time.Time
+}
+
+func newTemporaryGrants(entries []temporaryEntry) *[]temporaryGrant {
+	var grants []temporaryGrant
+	for _, entry := range entries {
+		grants = append(grants, temporaryGrant{matcher: newMatcher([]string{entry.entry}), until: entry.until})
+	}
+	if len(grants) == 0 {
+		return nil
+	}
+	return &grants
+}
+
+// temporaryAllows reports whether an unexpired temporary grant covers addr. Expired grants are
+// pruned by swapping in a new list, the lists themselves are never modified.
+func (g *Guard) temporaryAllows(addr net.IP) bool {
+	grants := g.grants.Load()
+	if grants == nil {
+		return false
+	}
+	now := g.now()
+	var allowed, expired bool
+	for _, grant := range *grants {
+		if !now.Before(grant.until) {
+			expired = true
+			continue
+		}
+		allowed = allowed || grant.matcher.contains(addr)
+	}
+	if expired {
+		var kept []temporaryGrant
+		for _, grant := range *grants {
+			if now.Before(grant.until) {
+				kept = append(kept, grant)
+			}
+		}
+		var next *[]temporaryGrant
+		if len(kept) > 0 {
+			next = &kept
+		}
+		g.grants.CompareAndSwap(grants, next)
+	}
+	return allowed
+}
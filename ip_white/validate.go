@@ -0,0 +1,117 @@
+package ip_white
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Validate checks the options with the parsers used at runtime and reports, one per line,
+// the entries that are ignored or would panic in NewGuard, and the redundant ones: duplicates
+// and entries already covered by a wider CIDR. When WithLogger is set each problem is also
+// logged as a warning. It returns nil for a clean configuration.
+func Validate(opts ...Option) error {
+	cfg := &option{IPSourceCacheTTL: time.Minute}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	var errs []error
+	errs = append(errs, validateWhiteList(cfg.WhiteList)...)
+	for _, port := range slices.Sorted(maps.Keys(cfg.PortWhiteLists)) {
+		for _, err := range validateWhiteList(cfg.PortWhiteLists[port]) {
+			errs = append(errs, fmt.Errorf("port %d: %w", port, err))
+		}
+	}
+	for _, entry := range cfg.TemporaryIPs {
+		if _, _, err := parseEntry(entry.entry); err != nil {
+			errs = append(errs, fmt.Errorf("temporary entry %q is ignored: %v", entry.entry, err))
+		}
+	}
+	for _, entry := range cfg.TrustedProxies {
+		if _, _, err := parseEntry(entry); err != nil {
+			errs = append(errs, fmt.Errorf("trusted proxy %q is ignored: %v", entry, err))
+		}
+	}
+	for _, pattern := range cfg.UserAgentRegexes {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs = append(errs, fmt.Errorf("user agent regex %q: %v", pattern, err))
+		}
+	}
+	for _, fp := range cfg.CertFingerprints {
+		if b, err := hex.DecodeString(normalizeFingerprint(fp)); err != nil || len(b) != 32 {
+			errs = append(errs, fmt.Errorf("client certificate fingerprint %q: not a hex SHA-256 digest", fp))
+		}
+	}
+	if cfg.NAT64Prefix != "" {
+		if _, err := parseNAT64Prefix(cfg.NAT64Prefix); err != nil {
+			errs = append(errs, fmt.Errorf("NAT64 prefix %q: %v", cfg.NAT64Prefix, err))
+		}
+	}
+	if cfg.Logger != nil {
+		for _, err := range errs {
+			cfg.Logger.Warnf("ip_white: %v", err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateWhiteList(whitelist []string) []error {
+	type parsed struct {
+		entry string
+		ip    net.IP
+		net   *net.IPNet
+	}
+	var errs []error
+	var entries []parsed
+	seen := make(map[string]string, len(whitelist))
+	for _, entry := range whitelist {
+		ip, ipNet, err := parseEntry(entry)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("whitelist entry %q is ignored: %v", entry, err))
+			continue
+		}
+		key := ip.String()
+		if ipNet != nil {
+			key = ipNet.String()
+		}
+		if first, ok := seen[key]; ok {
+			errs = append(errs, fmt.Errorf("whitelist entry %q duplicates %q", entry, first))
+			continue
+		}
+		seen[key] = entry
+		if ipNet != nil {
+			if host, _, _ := net.ParseCIDR(strings.TrimSpace(entry)); !host.Equal(ipNet.IP) {
+				errs = append(errs, fmt.Errorf("whitelist entry %q has host bits set, it matches %s", entry, ipNet))
+			}
+		}
+		entries = append(entries, parsed{entry: entry, ip: ip, net: ipNet})
+	}
+	for i, e := range entries {
+		for j, wider := range entries {
+			if i == j || wider.net == nil {
+				continue
+			}
+			if covered(e.ip, e.net, wider.net) {
+				errs = append(errs, fmt.Errorf("whitelist entry %q is already covered by %q", e.entry, wider.entry))
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// covered reports whether the IP or network is inside wider, and strictly narrower when it is a network.
+func covered(ip net.IP, ipNet *net.IPNet, wider *net.IPNet) bool {
+	if ipNet == nil {
+		return wider.Contains(ip)
+	}
+	ones, bits := ipNet.Mask.Size()
+	wOnes, wBits := wider.Mask.Size()
+	return bits == wBits && wOnes < ones && wider.Contains(ipNet.IP)
+}
@@ -2,15 +2,125 @@ package logger
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
 )
 
+// defaultCaptureContentTypes are the response types buffered by default, see WithCaptureContentTypes.
+var defaultCaptureContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/xml",
+	"application/javascript",
+	"application/x-www-form-urlencoded",
+	"+json",
+	"+xml",
+}
+
 type bodyWriter struct {
 	gin.ResponseWriter
 	body *bytes.Buffer
+	// types are the Content-Types buffered, checked on the first write. nil buffers everything.
+	types   []string
+	checked bool
+	skip    bool
+	// downloadThreshold is the size past which the response is logged as a download, see
+	// WithDownloadThreshold.
+	downloadThreshold int64
+	download          bool
+	filename          string
 }
 
-func (r bodyWriter) Write(b []byte) (int, error) {
-	r.body.Write(b)
+func (r *bodyWriter) Write(b []byte) (int, error) {
+	if r.capture(b) {
+		r.body.Write(b)
+	}
 	return r.ResponseWriter.Write(b)
 }
+
+func (r *bodyWriter) WriteString(s string) (int, error) {
+	if r.capture([]byte(s)) {
+		r.body.WriteString(s)
+	}
+	return r.ResponseWriter.WriteString(s)
+}
+
+// capture decides on the first write whether the response is buffered, then stops buffering
+// once it grows past downloadThreshold.
+func (r *bodyWriter) capture(next []byte) bool {
+	if !r.checked {
+		r.checked = true
+		r.check(next)
+	}
+	if !r.skip && r.downloadThreshold > 0 && int64(r.body.Len()+len(next)) > r.downloadThreshold {
+		r.download, r.skip = true, true
+		r.body = new(bytes.Buffer)
+	}
+	return !r.skip
+}
+
+// check skips attachments, responses declaring a Content-Length past downloadThreshold and
+// types that are not loggable. Without a Content-Type header the type is sniffed from the
+// first bytes, as net/http does.
+func (r *bodyWriter) check(first []byte) {
+	header := r.Header()
+	if disposition, params, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil &&
+		(disposition == "attachment" || params["filename"] != "") {
+		r.download, r.filename = true, params["filename"]
+	} else if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil &&
+		r.downloadThreshold > 0 && size > r.downloadThreshold {
+		r.download = true
+	}
+	if r.download {
+		r.skip = true
+		return
+	}
+	if r.types == nil {
+		return
+	}
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(first)
+	}
+	r.skip = !matchContentType(contentType, r.types)
+}
+
+// downloadSummary stands in for the body of a download, named after the Content-Disposition
+// filename or else the last path segment.
+func (r *bodyWriter) downloadSummary(urlPath string) string {
+	name := r.filename
+	if name == "" {
+		name = path.Base(urlPath)
+	}
+	return fmt.Sprintf("<file download: %s, %d bytes>", name, r.Size())
+}
+
+// matchContentType reports whether contentType matches one of types: "text/" matches a whole
+// top-level type, "+json" a structured syntax suffix, anything else the exact media type.
+func matchContentType(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		switch {
+		case strings.HasSuffix(t, "/"):
+			if strings.HasPrefix(mediaType, t) {
+				return true
+			}
+		case strings.HasPrefix(t, "+"):
+			if strings.HasSuffix(mediaType, t) {
+				return true
+			}
+		case mediaType == t:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package logger
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats exposes counters of a logger middleware, see WithStats. It is safe for concurrent use.
+type Stats struct {
+	sinkDropped      atomic.Int64
+	breakerOpen      atomic.Bool
+	inFlight         atomic.Int64
+	inFlightRejected atomic.Int64
+}
+
+// SinkDropped returns the number of entries dropped while the sink breaker was open.
+func (s *Stats) SinkDropped() int64 {
+	return s.sinkDropped.Load()
+}
+
+// SinkBreakerOpen reports whether the sink breaker is currently dropping entries.
+func (s *Stats) SinkBreakerOpen() bool {
+	return s.breakerOpen.Load()
+}
+
+// InFlight returns the number of requests currently handled, see WithInFlightLimit.
+func (s *Stats) InFlight() int64 {
+	return s.inFlight.Load()
+}
+
+// InFlightRejected returns the number of requests rejected above the WithInFlightLimit hard cap.
+func (s *Stats) InFlightRejected() int64 {
+	return s.inFlightRejected.Load()
+}
+
+// sinkBreaker trips after threshold consecutive sink failures and drops entries for
+// cooldown, then lets a single probe through: its success closes the breaker, its
+// failure opens it for another cooldown.
+type sinkBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	stats     *Stats
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	open     bool
+	probing  bool
+}
+
+func newSinkBreaker(threshold int, cooldown time.Duration) *sinkBreaker {
+	return &sinkBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether an entry may be written to the sink now.
+func (b *sinkBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return true
+	}
+	if !b.probing && now.Sub(b.openedAt) >= b.cooldown {
+		b.probing = true
+		return true
+	}
+	if b.stats != nil {
+		b.stats.sinkDropped.Add(1)
+	}
+	return false
+}
+
+// done records the outcome of a write allowed by allow.
+func (b *sinkBreaker) done(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		b.setOpen(false)
+		return
+	}
+	b.failures++
+	if b.open || b.failures >= b.threshold {
+		b.openedAt = now
+		b.setOpen(true)
+	}
+}
+
+func (b *sinkBreaker) setOpen(open bool) {
+	b.open = open
+	if b.stats != nil {
+		b.stats.breakerOpen.Store(open)
+	}
+}
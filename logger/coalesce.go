@@ -0,0 +1,91 @@
+package logger
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Coalescer merges consecutive access entries with the same method, route and status, e.g. of
+// health checks and pollers, into one entry whose Count is the number of requests. A run is
+// written when a different request arrives, once window has passed since its first request,
+// or on Close. It is safe for concurrent use and can be shared by several middlewares, only
+// entries of the same middleware are merged and each run is written through its own outputs.
+type Coalescer struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending *coalescedEntry
+	closed  bool
+}
+
+type coalescedEntry struct {
+	key       string
+	ctx       context.Context
+	param     LogFormatterParams
+	logBodies bool
+	cfg       *config
+	count     int
+	first     time.Time
+	last      time.Time
+	timer     *time.Timer
+}
+
+// NewCoalescer returns a Coalescer merging runs of identical requests within window.
+func NewCoalescer(window time.Duration) *Coalescer {
+	return &Coalescer{window: window}
+}
+
+// add holds entry until its run ends, or counts it in the pending run with the same key.
+// Entries are written while c.mu is held, which keeps them in order.
+func (c *Coalescer) add(entry *coalescedEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		entry.cfg.emit(entry.ctx, &entry.param, entry.logBodies)
+		return
+	}
+	if p := c.pending; p != nil && p.cfg == entry.cfg && p.key == entry.key && entry.param.TimeStamp.Sub(p.first) < c.window {
+		p.count++
+		p.last = entry.param.TimeStamp
+		return
+	}
+	c.flush()
+	entry.count, entry.first, entry.last = 1, entry.param.TimeStamp, entry.param.TimeStamp
+	entry.timer = time.AfterFunc(c.window, func() { c.expire(entry) })
+	c.pending = entry
+}
+
+// expire writes entry when its window elapsed without another request ending the run.
+func (c *Coalescer) expire(entry *coalescedEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == entry {
+		c.flush()
+	}
+}
+
+// flush writes the pending run, if any. c.mu must be held.
+func (c *Coalescer) flush() {
+	p := c.pending
+	if p == nil {
+		return
+	}
+	c.pending = nil
+	p.timer.Stop()
+	if p.count > 1 {
+		p.param.Count = p.count
+		p.param.setField("count", p.count)
+		p.param.setField("window", p.last.Sub(p.first).String())
+	}
+	p.cfg.emit(p.ctx, &p.param, p.logBodies)
+}
+
+// Close writes the pending run, later entries are written at once.
+func (c *Coalescer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush()
+	c.closed = true
+	return nil
+}
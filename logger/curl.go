@@ -0,0 +1,61 @@
+package logger
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// curlCommand rebuilds the request as a curl command line for WithCurlOnError. Credential
+// headers are masked and JSON bodies go through WithRedactKeys. A body cut by
+// WithMaxRequestBodyRead is left out, with a trailing comment, rather than replayed partially.
+func (c *config) curlCommand(ctx *gin.Context, body []byte, cut bool) string {
+	var b strings.Builder
+	b.WriteString("curl -X ")
+	b.WriteString(ctx.Request.Method)
+	b.WriteString(" ")
+	b.WriteString(shellQuote(c.requestURL(ctx)))
+
+	header := maskHeaders(ctx.Request.Header)
+	// curl computes the length itself
+	header.Del("Content-Length")
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			b.WriteString(" -H ")
+			b.WriteString(shellQuote(key + ": " + value))
+		}
+	}
+
+	if cut {
+		b.WriteString(" # body omitted, larger than ")
+		b.WriteString(strconv.FormatInt(c.maxRequestBodyRead, 10))
+		b.WriteString(" bytes")
+	} else if len(body) > 0 {
+		body = c.redactBody(ctx.Request.Header.Get("Content-Type"), body)
+		b.WriteString(" --data-binary ")
+		b.WriteString(shellQuote(string(body)))
+	}
+	return b.String()
+}
+
+// shellQuote single-quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// curlStatus reports whether an entry gets a curl command, see WithCurlMinStatus.
+func (c *config) curlStatus(status int) bool {
+	minStatus := c.curlMinStatus
+	if minStatus == 0 {
+		minStatus = http.StatusInternalServerError
+	}
+	return c.curlOnError && status >= minStatus
+}
@@ -0,0 +1,50 @@
+package logger
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"math"
+	"strings"
+)
+
+// decodeBody decompresses a gzip or deflate response body for logging. At most limit+1 bytes
+// are inflated so a compression bomb cannot exhaust memory, cut reports that the body was
+// longer. Unknown encodings and corrupt data are returned as they are.
+func decodeBody(encoding string, body []byte, limit int) (decoded []byte, cut bool) {
+	if len(body) == 0 {
+		return body, false
+	}
+	var r io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return body, false
+		}
+		defer zr.Close()
+		r = zr
+	case "deflate":
+		// "deflate" is zlib-wrapped per RFC 9110, some servers send raw deflate anyway
+		if zr, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			defer zr.Close()
+			r = zr
+		} else {
+			r = flate.NewReader(bytes.NewReader(body))
+		}
+	default:
+		return body, false
+	}
+
+	n := int64(limit)
+	if n < math.MaxInt64 {
+		n++
+	}
+	decoded, err := io.ReadAll(io.LimitReader(r, n))
+	if err != nil {
+		return body, false
+	}
+	return decoded, int64(len(decoded)) > int64(limit)
+}
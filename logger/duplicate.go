@@ -0,0 +1,44 @@
+package logger
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyKeyHeader is the request header used to recognise retried requests.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// maxSeenKeys bounds the number of idempotency keys remembered by seenSet.
+const maxSeenKeys = 10000
+
+// seenSet remembers idempotency keys for window to flag retried requests.
+type seenSet struct {
+	window  time.Duration
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newSeenSet(window time.Duration) *seenSet {
+	return &seenSet{window: window, entries: make(map[string]time.Time)}
+}
+
+// seen records key and reports whether it was already recorded within the window.
+func (s *seenSet) seen(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if first, ok := s.entries[key]; ok && now.Sub(first) < s.window {
+		return true
+	}
+	if len(s.entries) >= maxSeenKeys {
+		for k, first := range s.entries {
+			if now.Sub(first) >= s.window {
+				delete(s.entries, k)
+			}
+		}
+		if len(s.entries) >= maxSeenKeys {
+			s.entries = make(map[string]time.Time)
+		}
+	}
+	s.entries[key] = now
+	return false
+}
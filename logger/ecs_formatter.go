@@ -0,0 +1,133 @@
+package logger
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// ecsVersion is the Elastic Common Schema version the ECSFormatter output follows.
+const ecsVersion = "8.11.0"
+
+type ecsEntry struct {
+	Timestamp string        `json:"@timestamp"`
+	Message   string        `json:"message,omitempty"`
+	Log       *ecsLog       `json:"log,omitempty"`
+	ECS       ecsVersionObj `json:"ecs"`
+	HTTP      ecsHTTP       `json:"http"`
+	URL       ecsURL        `json:"url"`
+	Client    ecsClient     `json:"client"`
+	UserAgent *ecsUserAgent `json:"user_agent,omitempty"`
+	Event     ecsEvent      `json:"event"`
+	Trace     *ecsID        `json:"trace,omitempty"`
+	Span      *ecsID        `json:"span,omitempty"`
+	Error     *ecsError     `json:"error,omitempty"`
+}
+
+type ecsLog struct {
+	Logger string `json:"logger"`
+}
+
+type ecsVersionObj struct {
+	Version string `json:"version"`
+}
+
+type ecsHTTP struct {
+	Version  string      `json:"version,omitempty"`
+	Request  ecsRequest  `json:"request"`
+	Response ecsResponse `json:"response"`
+}
+
+type ecsRequest struct {
+	ID       string `json:"id,omitempty"`
+	Method   string `json:"method"`
+	Referrer string `json:"referrer,omitempty"`
+}
+
+type ecsResponse struct {
+	StatusCode int     `json:"status_code"`
+	Body       ecsBody `json:"body"`
+}
+
+type ecsBody struct {
+	Bytes int `json:"bytes"`
+}
+
+type ecsURL struct {
+	Path     string `json:"path"`
+	Query    string `json:"query,omitempty"`
+	Original string `json:"original,omitempty"`
+	Full     string `json:"full,omitempty"`
+}
+
+type ecsClient struct {
+	IP string `json:"ip,omitempty"`
+}
+
+type ecsUserAgent struct {
+	Original string `json:"original"`
+}
+
+type ecsEvent struct {
+	Duration int64  `json:"duration"`
+	Sequence uint64 `json:"sequence,omitempty"`
+}
+
+type ecsID struct {
+	ID string `json:"id"`
+}
+
+type ecsError struct {
+	Message string `json:"message"`
+	Type    string `json:"type,omitempty"`
+}
+
+// ECSFormatter renders the entry as Elastic Common Schema JSON, event.duration is in nanoseconds.
+func ECSFormatter(param LogFormatterParams) string {
+	path, query, _ := strings.Cut(param.Path, "?")
+	entry := ecsEntry{
+		Timestamp: param.TimeStamp.UTC().Format(time.RFC3339Nano),
+		Message:   param.Message,
+		ECS:       ecsVersionObj{Version: ecsVersion},
+		HTTP: ecsHTTP{
+			Version: strings.TrimPrefix(param.RequestProto, "HTTP/"),
+			Request: ecsRequest{
+				ID:       param.RequestId,
+				Method:   param.Method,
+				Referrer: param.RequestReferer,
+			},
+			Response: ecsResponse{
+				StatusCode: param.StatusCode,
+				Body:       ecsBody{Bytes: param.BodySize},
+			},
+		},
+		URL: ecsURL{
+			Path:     path,
+			Query:    query,
+			Original: param.Path,
+			Full:     param.RequestURL,
+		},
+		Client: ecsClient{IP: param.ClientIP},
+		Event:  ecsEvent{Duration: param.Latency.Nanoseconds(), Sequence: param.Sequence},
+	}
+	if param.Prefix != "" {
+		entry.Log = &ecsLog{Logger: param.Prefix}
+	}
+	if param.RequestUserAgent != "" {
+		entry.UserAgent = &ecsUserAgent{Original: param.RequestUserAgent}
+	}
+	if param.TraceId != "" {
+		entry.Trace = &ecsID{ID: param.TraceId}
+	}
+	if param.SpanId != "" {
+		entry.Span = &ecsID{ID: param.SpanId}
+	}
+	if param.ErrorMessage != "" {
+		entry.Error = &ecsError{Message: param.ErrorMessage, Type: param.PanicType}
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return defaultLogFormatter(param)
+	}
+	return string(b)
+}
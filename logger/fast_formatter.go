@@ -0,0 +1,107 @@
+package logger
+
+import (
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var fastBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
+// FastTextFormatter renders the same line as the default formatter with pooled byte
+// appends instead of fmt and reflection. The only allocation is the returned string.
+func FastTextFormatter(param LogFormatterParams) string {
+	bp := fastBufferPool.Get().(*[]byte)
+	buf := (*bp)[:0]
+
+	latency := param.Latency
+	if latency > time.Minute {
+		latency = latency - latency%time.Second
+	}
+
+	if param.Prefix != "" {
+		buf = append(buf, param.Prefix...)
+		buf = append(buf, ' ')
+	}
+	start := len(buf)
+	buf = padLeft(strconv.AppendInt(buf, int64(param.StatusCode), 10), start, 3)
+	buf = append(buf, " | "...)
+	start = len(buf)
+	buf = padLeft(appendDuration(buf, latency), start, 13)
+	buf = append(buf, " | "...)
+	start = len(buf)
+	buf = padLeft(append(buf, param.ClientIP...), start, 15)
+	buf = append(buf, " | "...)
+	buf = append(buf, param.Method...)
+	for i := len(param.Method); i < 7; i++ {
+		buf = append(buf, ' ')
+	}
+	buf = append(buf, ' ')
+	buf = strconv.AppendQuote(buf, param.Path)
+	buf = append(buf, ' ')
+	buf = append(buf, param.ErrorMessage...)
+	if param.Count > 1 {
+		buf = append(buf, " x"...)
+		buf = strconv.AppendInt(buf, int64(param.Count), 10)
+	}
+
+	line := string(buf)
+	*bp = buf
+	fastBufferPool.Put(bp)
+	return line
+}
+
+// padLeft right-aligns the field appended to buf from start on to width runes, like fmt does.
+// The field is part of buf, so appending it may reallocate freely.
+func padLeft(buf []byte, start, width int) []byte {
+	pad := width - utf8.RuneCount(buf[start:])
+	if pad <= 0 {
+		return buf
+	}
+	n := len(buf)
+	for i := 0; i < pad; i++ {
+		buf = append(buf, ' ')
+	}
+	copy(buf[start+pad:], buf[start:n])
+	for i := 0; i < pad; i++ {
+		buf[start+i] = ' '
+	}
+	return buf
+}
+
+// appendDuration appends d in a form close to time.Duration.String.
+func appendDuration(buf []byte, d time.Duration) []byte {
+	switch {
+	case d == 0:
+		return append(buf, "0s"...)
+	case d < time.Microsecond:
+		buf = strconv.AppendInt(buf, int64(d), 10)
+		return append(buf, "ns"...)
+	case d < time.Millisecond:
+		buf = strconv.AppendFloat(buf, float64(d)/float64(time.Microsecond), 'f', -1, 64)
+		return append(buf, "µs"...)
+	case d < time.Second:
+		buf = strconv.AppendFloat(buf, float64(d)/float64(time.Millisecond), 'f', -1, 64)
+		return append(buf, "ms"...)
+	default:
+		if d >= time.Hour {
+			buf = strconv.AppendInt(buf, int64(d/time.Hour), 10)
+			buf = append(buf, 'h')
+			d %= time.Hour
+			buf = strconv.AppendInt(buf, int64(d/time.Minute), 10)
+			buf = append(buf, 'm')
+		} else if d >= time.Minute {
+			buf = strconv.AppendInt(buf, int64(d/time.Minute), 10)
+			buf = append(buf, 'm')
+		}
+		d %= time.Minute
+		buf = strconv.AppendFloat(buf, d.Seconds(), 'f', -1, 64)
+		return append(buf, 's')
+	}
+}
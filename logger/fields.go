@@ -0,0 +1,42 @@
+package logger
+
+import (
+	"sync/atomic"
+)
+
+// counterValue coerces a counter stored in c.Keys: signed and unsigned integers become
+// int64, floats become float64 and *atomic.Int64/*atomic.Uint64 are loaded. Anything
+// else, numeric strings included, is skipped.
+func counterValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		return int64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case *atomic.Int64:
+		return v.Load(), true
+	case *atomic.Uint64:
+		return int64(v.Load()), true
+	}
+	return nil, false
+}
@@ -0,0 +1,207 @@
+package logger
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat suffixes rotated files, it sorts in rotation order.
+const backupTimeFormat = "20060102T150405.000"
+
+// FileSink is a LogSink appending entries to a file as NDJSON, one JSONFormatter object per
+// line. The file is rotated when a write would make it exceed its size limit or when the day
+// changes, the rotated file being renamed with a timestamp suffix, and only the newest
+// backups are kept. It is safe for concurrent use.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	now        func() time.Time
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	day  string
+}
+
+// NewFileSink opens, or creates, the NDJSON file at path. Files are rotated past maxSizeMB
+// megabytes, 0 meaning no size limit, and at most maxBackups rotated files are kept, 0 keeping
+// them all.
+func NewFileSink(path string, maxSizeMB, maxBackups int) (*FileSink, error) {
+	s := &FileSink{
+		path:       path,
+		maxSize:    int64(maxSizeMB) << 20,
+		maxBackups: maxBackups,
+		now:        time.Now,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	s.day = info.ModTime().Format(time.DateOnly)
+	if s.size == 0 {
+		s.day = s.now().Format(time.DateOnly)
+	}
+	return nil
+}
+
+// Write appends params as one JSON line.
+func (s *FileSink) Write(_ context.Context, params LogFormatterParams) error {
+	line := JSONFormatter(params) + "\n"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	now := s.now()
+	if s.size > 0 && (s.day != now.Format(time.DateOnly) || s.maxSize > 0 && s.size+int64(len(line)) > s.maxSize) {
+		if err := s.rotate(now); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.WriteString(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate renames the current file to a timestamped backup, reopens path and prunes the
+// backups beyond maxBackups.
+func (s *FileSink) rotate(now time.Time) error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	renameErr := os.Rename(s.path, s.backupName(now))
+	// reopen even when the rename failed, so that the sink keeps writing
+	if err := s.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	s.day = now.Format(time.DateOnly)
+	return s.prune()
+}
+
+// backupName returns the name of a backup rotated at now. Rotations within the same
+// millisecond get a counter suffix, as os.Rename would replace the earlier backup.
+func (s *FileSink) backupName(now time.Time) string {
+	name := s.path + "." + now.Format(backupTimeFormat)
+	for n := 1; ; n++ {
+		// any other error is left to os.Rename to report
+		if _, err := os.Lstat(name); err != nil {
+			return name
+		}
+		name = s.path + "." + now.Format(backupTimeFormat) + "." + strconv.Itoa(n)
+	}
+}
+
+func (s *FileSink) prune() error {
+	if s.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := s.backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > s.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// backups returns the rotated files of the sink, oldest first.
+func (s *FileSink) backups() ([]string, error) {
+	dir, base := filepath.Split(s.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type backup struct {
+		path  string
+		stamp string
+		n     int
+	}
+	var found []backup
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), base+".")
+		if !ok || entry.IsDir() || len(suffix) < len(backupTimeFormat) {
+			continue
+		}
+		stamp, counter := suffix[:len(backupTimeFormat)], suffix[len(backupTimeFormat):]
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		n := 0
+		if counter != "" {
+			digits, ok := strings.CutPrefix(counter, ".")
+			if n, err = strconv.Atoi(digits); !ok || err != nil || n < 1 {
+				continue
+			}
+		}
+		found = append(found, backup{path: filepath.Join(dir, entry.Name()), stamp: stamp, n: n})
+	}
+	// the counter of same-time backups sorts numerically, ".10" after ".9"
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].stamp != found[j].stamp {
+			return found[i].stamp < found[j].stamp
+		}
+		return found[i].n < found[j].n
+	})
+	out := make([]string, len(found))
+	for i, b := range found {
+		out[i] = b.path
+	}
+	return out, nil
+}
+
+// Flush commits the written entries to stable storage.
+func (s *FileSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Sync()
+}
+
+// Close flushes and closes the file, later writes fail with os.ErrClosed.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	return err
+}
@@ -0,0 +1,36 @@
+package logger
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type inFlightLimit struct {
+	warnAt  int64
+	hardCap int64
+}
+
+// enterInFlight counts the request as in flight. Above the hard cap it aborts the request with
+// 503 and returns false, the caller must otherwise call leaveInFlight once the request is done.
+func (c *config) enterInFlight(ctx *gin.Context) bool {
+	n := c.stats.inFlight.Add(1)
+	if c.inFlight.hardCap > 0 && n > c.inFlight.hardCap {
+		c.stats.inFlight.Add(-1)
+		c.stats.inFlightRejected.Add(1)
+		if c.logger != nil {
+			c.logger.Warnf("in-flight requests above %d, rejected %s %s", c.inFlight.hardCap, ctx.Request.Method, ctx.Request.URL.Path)
+		}
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+		return false
+	}
+	// Only the request crossing the threshold logs, not every request above it.
+	if c.inFlight.warnAt > 0 && n == c.inFlight.warnAt && c.logger != nil {
+		c.logger.Warnf("in-flight requests reached %d", n)
+	}
+	return true
+}
+
+func (c *config) leaveInFlight() {
+	c.stats.inFlight.Add(-1)
+}
@@ -0,0 +1,30 @@
+package logger
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Instrument returns a middleware that only times the request and hands the lightweight
+// fields (TimeStamp, StatusCode, Latency, ClientIP, Method, Path, BodySize, ErrorMessage)
+// to observer. It buffers no body, formats nothing and writes no log line.
+func Instrument(observer func(LogFormatterParams)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		param := LogFormatterParams{
+			TimeStamp:  time.Now(),
+			StatusCode: c.Writer.Status(),
+			ClientIP:   c.ClientIP(),
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.Path,
+			BodySize:   c.Writer.Size(),
+		}
+		param.Latency = param.TimeStamp.Sub(start)
+		if len(c.Errors) > 0 {
+			param.ErrorMessage = c.Errors.ByType(gin.ErrorTypePrivate).String()
+		}
+		observer(param)
+	}
+}
@@ -0,0 +1,50 @@
+package logger
+
+import (
+	"encoding/json"
+	"time"
+)
+
+type jsonEntry struct {
+	Logger    string                 `json:"logger,omitempty"`
+	Timestamp string                 `json:"timestamp"`
+	Status    int                    `json:"status"`
+	LatencyMs int64                  `json:"latency_ms"`
+	ClientIP  string                 `json:"client_ip"`
+	Method    string                 `json:"method"`
+	Path      string                 `json:"path"`
+	Error     string                 `json:"error,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	TraceID   string                 `json:"trace_id,omitempty"`
+	SpanID    string                 `json:"span_id,omitempty"`
+	BodySize  int                    `json:"body_size"`
+	Sequence  uint64                 `json:"sequence,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// JSONFormatter renders the entry as a compact JSON object with stable keys, the latency in
+// whole milliseconds and the timestamp in RFC 3339. Unset optional fields are omitted.
+func JSONFormatter(param LogFormatterParams) string {
+	b, err := json.Marshal(jsonEntry{
+		Logger:    param.Prefix,
+		Timestamp: param.TimeStamp.Format(time.RFC3339),
+		Status:    param.StatusCode,
+		LatencyMs: param.Latency.Milliseconds(),
+		ClientIP:  param.ClientIP,
+		Method:    param.Method,
+		Path:      param.Path,
+		Error:     param.ErrorMessage,
+		RequestID: param.RequestId,
+		TraceID:   param.TraceId,
+		SpanID:    param.SpanId,
+		BodySize:  param.BodySize,
+		Sequence:  param.Sequence,
+		Fields:    param.Fields,
+	})
+	if err != nil {
+		// a field value that cannot be marshalled must not lose the entry
+		param.Fields = nil
+		return JSONFormatter(param)
+	}
+	return string(b)
+}
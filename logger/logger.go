@@ -2,21 +2,41 @@ package logger
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"github.com/donetkit/contrib-log/glog"
+	"github.com/donetkit/contrib/utils/uuid"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"hash/fnv"
 	"io"
 	"math"
+	"net/http"
+	"net/url"
+	"reflect"
 	"regexp"
+	"runtime"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"time"
 )
 
-var cfg *config
-
 type consoleColorModeValue int
 
 type RequestLabelMappingFn func(c *gin.Context) string
 
+// FullPathLabel labels requests with their route template, e.g. "/users/:id", keeping log
+// and metric cardinality low. Unmatched requests, such as 404s, keep their raw path.
+func FullPathLabel(c *gin.Context) string {
+	if path := c.FullPath(); path != "" {
+		return path
+	}
+	return c.Request.URL.Path
+}
+
 // LogFormatter gives the signature of the formatter function passed to LoggerWithFormatter
 type LogFormatter func(params LogFormatterParams) string
 
@@ -26,6 +46,8 @@ type LogFormatterParams struct {
 	TimeStamp time.Time
 	// StatusCode is HTTP response code.
 	StatusCode int
+	// AppStatus is the application status read from the header set by WithAppStatusHeader.
+	AppStatus string
 	// Latency is how much time the webServe cost to process a certain request.
 	Latency time.Duration
 	// ClientIP equals Context's ClientIP method.
@@ -36,23 +58,62 @@ type LogFormatterParams struct {
 	Path string
 	// ErrorMessage is set if error has occurred in processing the request.
 	ErrorMessage string
+	// PanicType is the dynamic type of a recovered panic value.
+	PanicType string
+	// PanicErrorChain lists "type: message" for each error unwrapped from a recovered error.
+	PanicErrorChain []string
 	// isTerm shows whether does gin's output descriptor refers to a terminal.
 	isTerm bool
 	// BodySize is the size of the Response Body
 	BodySize int
 	// Keys are the keys set on the request's context.
 	Keys map[string]interface{}
+	// Fields are the extra structured fields collected by options such as WithBaggageKeys.
+	Fields map[string]interface{}
+	// Message is the one line summary used by structured formatters, see WithMessageFn.
+	Message string
 
 	RequestData      string
 	RequestUserAgent string
 	RequestReferer   string
 	RequestProto     string
+	// RequestURL is the absolute request URL, set when WithFullURL is enabled.
+	RequestURL string
+
+	// HandlerName, HandlerLocation and HandlerNames are set when WithCallerInfo is enabled.
+	HandlerName     string
+	HandlerLocation string
+	HandlerNames    []string
 
 	RequestId string
 	TraceId   string
 	SpanId    string
 
+	// IdempotencyKey and Duplicate are set when WithDuplicateDetection is enabled.
+	IdempotencyKey string
+	Duplicate      bool
+	// HandlerLatency is the time spent after the upstream middleware stored its end time under
+	// the WithHandlerStartKey key, zero when the key is absent.
+	HandlerLatency time.Duration
+	// MiddlewareLatency is the time spent in the middlewares between the logger and the
+	// MarkHandlerStart middleware, set with HandlerLatency when WithMiddlewareLatency is enabled.
+	MiddlewareLatency time.Duration
+	// Prefix is the WithPrefix tag. Text formatters put it in front of the line, structured
+	// formatters render it as a logger field.
+	Prefix string
+	// Count is the number of identical consecutive requests the entry stands for when
+	// WithCoalesce merged several of them, 0 otherwise. Text formatters render it as " xN".
+	Count int
+	// Sequence is the emission order of the entry within the middleware instance, starting at 1,
+	// when WithSequenceNumbers is enabled. Only structured formatters render it.
+	Sequence uint64
+
 	ResponseData string
+
+	// RequestHeaders and ResponseHeaders are copies of the headers, credentials masked, set when
+	// WithCaptureHeaders is enabled and the bodies are captured.
+	RequestHeaders  http.Header
+	ResponseHeaders http.Header
 }
 
 // defaultLogFormatter is the default log format function Logger middleware uses.
@@ -61,7 +122,7 @@ var defaultLogFormatter = func(param LogFormatterParams) string {
 		// Truncate in a golang < 1.8 safe way
 		param.Latency = param.Latency - param.Latency%time.Second
 	}
-	return fmt.Sprintf("%3d | %13v | %15s | %-7s %#v %s",
+	line := fmt.Sprintf("%3d | %13v | %15s | %-7s %#v %s",
 		param.StatusCode,
 		param.Latency,
 		param.ClientIP,
@@ -69,47 +130,52 @@ var defaultLogFormatter = func(param LogFormatterParams) string {
 		param.Path,
 		param.ErrorMessage,
 	)
+	if param.Count > 1 {
+		line += fmt.Sprintf(" x%d", param.Count)
+	}
+	if param.Prefix != "" {
+		return param.Prefix + " " + line
+	}
+	return line
 }
 
 // NewErrorLogger returns a handler func for any error type.
 func NewErrorLogger(opts ...Option) gin.HandlerFunc {
-	if cfg == nil {
-		cfg = &config{
-			endpointLabelMappingFn: func(c *gin.Context) string {
-				return c.Request.URL.Path
-			}}
-	}
-	for _, opt := range opts {
-		opt(cfg)
-	}
-	if cfg.formatter == nil {
-		cfg.formatter = defaultLogFormatter
-	}
-
-	return ErrorLoggerT(gin.ErrorTypeAny)
+	return ErrorLoggerT(gin.ErrorTypeAny, opts...)
 }
 
-// ErrorLoggerT returns a handler func for a given error type.
-func ErrorLoggerT(typ gin.ErrorType) gin.HandlerFunc {
+// ErrorLoggerT returns a handler func for a given error type. Every call builds its own
+// config from opts, handlers never share settings.
+func ErrorLoggerT(typ gin.ErrorType, opts ...Option) gin.HandlerFunc {
+	cfg := &config{
+		rawDataLength:       math.MaxInt,
+		bodyLength:          math.MaxInt,
+		redactQueryKeys:     newKeySet(defaultRedactQueryKeys),
+		captureContentTypes: defaultCaptureContentTypes,
+		downloadThreshold:   defaultDownloadThreshold,
+		endpointLabelMappingFn: func(c *gin.Context) string {
+			return c.Request.URL.Path
+		}}
+	cfg.apply(opts)
+
 	isTerm := true
 	return func(c *gin.Context) {
 		defer func() {
 			if errRecover := recover(); errRecover != nil {
-				if cfg.logger == nil {
-					return
-				}
 				var recoverErr = fmt.Sprintf("%s", errRecover)
-				cfg.logger.Error(string(debug.Stack()))
+				if cfg.logger != nil && cfg.allowErrorLog(cfg.endpointLabelMappingFn(c)+" panic") {
+					cfg.logger.Error(string(debug.Stack()))
+				}
 				start := time.Now() // Start timer
 				method := c.Request.Method
 				endpoint := cfg.endpointLabelMappingFn(c)
 				isOk := cfg.checkLabel(fmt.Sprintf("%d", c.Writer.Status()), cfg.excludeRegexStatus) && cfg.checkLabel(endpoint, cfg.excludeRegexEndpoint) && cfg.checkLabel(method, cfg.excludeRegexMethod)
-				if !isOk {
-					return
-				}
-				rawData, err := c.GetRawData()
-				if err == nil {
-					c.Request.Body = io.NopCloser(bytes.NewBuffer(rawData))
+				// excluded requests still get the error response, they are only not logged
+				capture := isOk && cfg.captureBody(c)
+				var rawData []byte
+				var requestCut bool
+				if capture && cfg.captureRequestBody(c) {
+					rawData, requestCut = readRequestBody(c.Request, cfg.maxRequestBodyRead)
 				}
 				raw := c.Request.URL.RawQuery
 				param := LogFormatterParams{
@@ -119,44 +185,60 @@ func ErrorLoggerT(typ gin.ErrorType) gin.HandlerFunc {
 				// Stop timer
 				param.ClientIP = c.ClientIP()
 				param.Method = method
-				param.StatusCode = c.Writer.Status()
+				param.StatusCode = responseStatus(c.Writer)
 				param.BodySize = c.Writer.Size()
 				if raw != "" {
-					endpoint = endpoint + "?" + raw
+					endpoint = endpoint + "?" + cfg.redactQuery(raw)
 				}
 				param.Path = endpoint
 				param.TimeStamp = time.Now()
 				param.Latency = param.TimeStamp.Sub(start)
 				param.ErrorMessage = recoverErr
+				param.PanicType = fmt.Sprintf("%T", errRecover)
+				if err, ok := errRecover.(error); ok {
+					param.PanicErrorChain = errorChain(err)
+				}
 				param.RequestProto = c.Request.Proto
 				param.RequestUserAgent = c.Request.UserAgent()
 				param.RequestReferer = c.Request.Referer()
-				param.RequestId = c.Request.Header.Get("X-Request-Id")
-
-				writer := &bodyWriter{body: bytes.NewBufferString(""), ResponseWriter: c.Writer}
-				c.Writer = writer
-
-				if len(rawData) <= cfg.bodyLength {
-					param.RequestData = string(rawData)
-				} else {
-					param.ResponseData = fmt.Sprintf("request data is too large, limit size: %d \n%s", cfg.bodyLength, string(rawData[0:cfg.bodyLength]))
+				param.RequestId = cfg.requestID(c)
+				if cfg.fullURL {
+					param.RequestURL = cfg.requestURL(c)
+				}
+				if cfg.callerInfo {
+					setCallerInfo(c, &param)
 				}
+				cfg.setFields(c, &param)
 
-				if writer.body.Len() <= cfg.rawDataLength {
-					param.ResponseData = writer.body.String()
-				} else {
-					param.ResponseData = fmt.Sprintf("response data is too large, limit size: %d \n%s", cfg.rawDataLength, string(writer.body.Bytes()[0:cfg.rawDataLength]))
+				if capture && cfg.bodySink != nil {
+					cfg.bodySink(param.RequestId, bytes.Clone(rawData), nil)
+				} else if capture {
+					writer := &bodyWriter{body: bytes.NewBufferString(""), ResponseWriter: c.Writer, types: cfg.responseTypes(), downloadThreshold: cfg.downloadThreshold}
+					c.Writer = writer
+					cfg.setBodies(c, &param, rawData, requestCut, writer.body.Bytes())
 				}
 
-				cfg.logger.Debugf("%v", param)
+				param.Prefix = cfg.prefix
+				cfg.setTrace(c, &param)
+				if cfg.enrich != nil {
+					cfg.enrich(c, &param)
+				}
+				param.Message = cfg.message(&param)
 				if cfg.writerErrorFn != nil {
 					code, msg := cfg.writerErrorFn(c, &param)
 					c.JSON(code, msg)
 					c.Abort()
+				} else {
+					c.AbortWithStatusJSON(http.StatusInternalServerError, cfg.panicResponse(&param))
+				}
+				if !isOk {
 					return
 				}
-				c.JSON(-1, param.ErrorMessage)
-				c.Abort()
+				// log the status actually sent, for WithStatusLevelMap and the formatters
+				param.StatusCode = responseStatus(c.Writer)
+				param.BodySize = c.Writer.Size()
+				param.Message = cfg.message(&param)
+				cfg.emit(c.Request.Context(), &param, capture && cfg.bodySink == nil)
 			}
 		}()
 		c.Next()
@@ -164,44 +246,123 @@ func ErrorLoggerT(typ gin.ErrorType) gin.HandlerFunc {
 	}
 }
 
-// New instances a Logger middleware that will write the logs to gin.DefaultWriter. By default gin.DefaultWriter = os.Stdout.
-func New(opts ...Option) gin.HandlerFunc {
-	if cfg == nil {
-		cfg = &config{
-			rawDataLength: math.MaxInt,
-			bodyLength:    math.MaxInt,
-			endpointLabelMappingFn: func(c *gin.Context) string {
-				return c.Request.URL.Path
-			}}
-	}
-	for _, opt := range opts {
-		opt(cfg)
+// Recovery returns a handler func that only recovers panics: the stack goes to the logger and
+// the client gets the PanicResponse, or the WriterErrorFn answer. Unlike ErrorLoggerT it never
+// buffers bodies nor measures latency.
+func Recovery(opts ...Option) gin.HandlerFunc {
+	cfg := &config{
+		endpointLabelMappingFn: func(c *gin.Context) string {
+			return c.Request.URL.Path
+		}}
+	cfg.apply(opts)
+
+	return func(c *gin.Context) {
+		defer func() {
+			errRecover := recover()
+			if errRecover == nil {
+				return
+			}
+			endpoint := cfg.endpointLabelMappingFn(c)
+			if cfg.logger != nil && cfg.allowErrorLog(endpoint+" panic") {
+				cfg.logger.Errorf("panic recovered: %s %s: %v\n%s", c.Request.Method, endpoint, errRecover, debug.Stack())
+			}
+			param := LogFormatterParams{
+				TimeStamp:    time.Now(),
+				StatusCode:   http.StatusInternalServerError,
+				ClientIP:     c.ClientIP(),
+				Method:       c.Request.Method,
+				Path:         endpoint,
+				ErrorMessage: fmt.Sprintf("%s", errRecover),
+				PanicType:    fmt.Sprintf("%T", errRecover),
+				RequestId:    cfg.requestID(c),
+			}
+			if cfg.writerErrorFn != nil {
+				code, msg := cfg.writerErrorFn(c, &param)
+				c.AbortWithStatusJSON(code, msg)
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, cfg.panicResponse(&param))
+		}()
+		c.Next()
 	}
-	if cfg.formatter == nil {
-		cfg.formatter = defaultLogFormatter
+}
+
+// PanicResponse is the body ErrorLoggerT answers a recovered panic with when no WriterErrorFn
+// is set. The panic message is only logged, unless WithExposePanicMessage is set.
+type PanicResponse struct {
+	Code      int    `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+func (c *config) panicResponse(param *LogFormatterParams) PanicResponse {
+	message := "internal server error"
+	if c.exposePanicMessage {
+		message = param.ErrorMessage
 	}
+	return PanicResponse{Code: http.StatusInternalServerError, Message: message, RequestID: param.RequestId}
+}
+
+// New instances a Logger middleware that will write the logs to gin.DefaultWriter. By default gin.DefaultWriter = os.Stdout.
+// Every call builds its own config from opts, handlers never share settings.
+func New(opts ...Option) gin.HandlerFunc {
+	cfg := &config{
+		rawDataLength:       math.MaxInt,
+		bodyLength:          math.MaxInt,
+		redactQueryKeys:     newKeySet(defaultRedactQueryKeys),
+		loggedErrorTypes:    gin.ErrorTypePrivate,
+		captureContentTypes: defaultCaptureContentTypes,
+		downloadThreshold:   defaultDownloadThreshold,
+		requestIDGenerator:  uuid.NewUUID,
+		endpointLabelMappingFn: func(c *gin.Context) string {
+			return c.Request.URL.Path
+		}}
+	cfg.apply(opts)
 
 	isTerm := true
 	//gin.DefaultWriter = &writeLogger{pool: buffer.Pool{}}
 	return func(c *gin.Context) {
-		if cfg.logger == nil {
+		if cfg.inFlight != nil {
+			if !cfg.enterInFlight(c) {
+				return
+			}
+			// deferred so panics further down the chain still release the slot
+			defer cfg.leaveInFlight()
+		}
+		if (cfg.logger == nil && cfg.output == nil && cfg.sink == nil) || cfg.skipPath(c.Request.URL.Path) {
+			// run the chain here so the deferred release waits for it
+			c.Next()
 			return
 		}
+		cfg.ensureRequestID(c)
 		start := time.Now() // Start timer
 		method := c.Request.Method
 		endpoint := cfg.endpointLabelMappingFn(c)
 		isOk := cfg.checkLabel(fmt.Sprintf("%d", c.Writer.Status()), cfg.excludeRegexStatus) && cfg.checkLabel(endpoint, cfg.excludeRegexEndpoint) && cfg.checkLabel(method, cfg.excludeRegexMethod)
 		if !isOk {
+			c.Next()
 			return
 		}
-		rawData, err := c.GetRawData()
-		if err == nil {
-			c.Request.Body = io.NopCloser(bytes.NewBuffer(rawData))
+		capture := cfg.captureBody(c)
+		var requestHeaders http.Header
+		if capture && cfg.captureHeaders {
+			requestHeaders = maskHeaders(c.Request.Header)
+		}
+		var rawData []byte
+		var requestCut bool
+		var writer *bodyWriter
+		if capture {
+			if cfg.captureRequestBody(c) {
+				rawData, requestCut = readRequestBody(c.Request, cfg.maxRequestBodyRead)
+			}
+			writer = &bodyWriter{body: bytes.NewBufferString(""), ResponseWriter: c.Writer, types: cfg.responseTypes(), downloadThreshold: cfg.downloadThreshold}
+			c.Writer = writer
 		}
-		writer := &bodyWriter{body: bytes.NewBufferString(""), ResponseWriter: c.Writer}
-		c.Writer = writer
 		// Process request
 		c.Next()
+		if cfg.skipPreflight && isPreflight(c) {
+			return
+		}
 		raw := c.Request.URL.RawQuery
 		param := LogFormatterParams{
 			isTerm: isTerm,
@@ -210,58 +371,496 @@ func New(opts ...Option) gin.HandlerFunc {
 		// Stop timer
 		param.ClientIP = c.ClientIP()
 		param.Method = method
-		param.StatusCode = c.Writer.Status()
+		param.StatusCode = responseStatus(c.Writer)
 		param.BodySize = c.Writer.Size()
+		if cfg.appStatusHeader != "" {
+			param.AppStatus = appStatus(c.Writer.Header(), cfg.appStatusHeader)
+		}
+		label := endpoint
 		if raw != "" {
-			endpoint = endpoint + "?" + raw
+			endpoint = endpoint + "?" + cfg.redactQuery(raw)
 		}
 		param.Path = endpoint
 		param.TimeStamp = time.Now()
 		param.Latency = param.TimeStamp.Sub(start)
-		param.ErrorMessage = c.Errors.ByType(gin.ErrorTypePrivate).String()
+		param.ErrorMessage = c.Errors.ByType(cfg.loggedErrorTypes).String()
+		param.RequestProto = c.Request.Proto
+		param.RequestUserAgent = c.Request.UserAgent()
+		param.RequestReferer = c.Request.Referer()
+		param.RequestId = cfg.requestID(c)
+		if requestHeaders != nil {
+			param.RequestHeaders = requestHeaders
+			param.ResponseHeaders = maskHeaders(c.Writer.Header())
+		}
+		if cfg.fullURL {
+			param.RequestURL = cfg.requestURL(c)
+		}
+		if cfg.callerInfo {
+			setCallerInfo(c, &param)
+		}
+		cfg.setFields(c, &param)
+		if cfg.duplicates != nil {
+			if key := c.Request.Header.Get(idempotencyKeyHeader); key != "" {
+				param.IdempotencyKey = key
+				param.Duplicate = cfg.duplicates.seen(key, start)
+			}
+		}
 
-		if len(rawData) <= cfg.bodyLength {
-			param.RequestData = string(rawData)
-		} else {
-			param.ResponseData = fmt.Sprintf("request data is too large, limit size: %d \n%s", cfg.bodyLength, string(rawData[0:cfg.bodyLength]))
+		if cfg.curlStatus(param.StatusCode) {
+			param.setField("curl", cfg.curlCommand(c, rawData, requestCut))
+		}
+		if capture && cfg.responseHash {
+			cfg.setResponseHash(&param, writer)
 		}
 
-		if writer.body.Len() <= cfg.rawDataLength {
-			param.ResponseData = writer.body.String()
-		} else {
-			param.ResponseData = fmt.Sprintf("response data is too large, limit size: %d \n%s", cfg.rawDataLength, string(writer.body.Bytes()[0:cfg.rawDataLength]))
+		// WithBodyOnSlow: bodies were buffered anyway, only keep them for slow requests
+		logBodies := capture && param.Latency >= cfg.bodyOnSlow
+		if logBodies && cfg.bodySink != nil {
+			// bodies go to the body sink only, the access line references them by request id
+			cfg.bodySink(param.RequestId, bytes.Clone(rawData), bytes.Clone(writer.body.Bytes()))
+			logBodies = false
+		} else if logBodies {
+			cfg.setBodies(c, &param, rawData, requestCut, writer.body.Bytes())
+			if writer.download {
+				param.ResponseData = writer.downloadSummary(c.Request.URL.Path)
+			}
 		}
 
-		cfg.logger.Debugf("Request : %s", param.RequestData)
-		cfg.logger.Debugf("Response: %s", param.ResponseData)
-		cfg.logger.Debugf("%s", cfg.formatter(param))
+		param.Prefix = cfg.prefix
+		cfg.setTrace(c, &param)
+		if cfg.enrich != nil {
+			cfg.enrich(c, &param)
+		}
+		param.Message = cfg.message(&param)
+		if cfg.metricsHook != nil {
+			cfg.metricsHook(param.Method, label, param.StatusCode, param.Latency)
+		}
+
+		if param.StatusCode < http.StatusInternalServerError || cfg.allowErrorLog(fmt.Sprintf("%s %d", cfg.endpointLabelMappingFn(c), param.StatusCode)) {
+			if cfg.coalescer != nil {
+				cfg.coalescer.add(&coalescedEntry{
+					key:       fmt.Sprintf("%s %s %d", param.Method, label, param.StatusCode),
+					ctx:       context.WithoutCancel(c.Request.Context()),
+					param:     param,
+					logBodies: logBodies,
+					cfg:       cfg,
+				})
+			} else {
+				cfg.emit(c.Request.Context(), &param, logBodies)
+			}
+		}
 
 		if cfg.writerLogFn != nil {
-			param.RequestProto = c.Request.Proto
-			param.RequestUserAgent = c.Request.UserAgent()
-			param.RequestReferer = c.Request.Referer()
-			param.RequestId = c.Request.Header.Get("X-Request-Id")
 			cfg.writerLogFn(c, &param)
 		}
 
 	}
 }
 
-// checkLabel returns the match result of labels.
-// Return true if regex-pattern compiles failed.
-func (c *config) checkLabel(label string, patterns []string) bool {
-	if len(patterns) <= 0 {
+// setBodies fills RequestData and ResponseData, redacting JSON bodies before truncating them
+// so that no secret survives in the kept part. A limit of 0 leaves the field empty. reqCut
+// reports a request body cut by WithMaxRequestBodyRead.
+func (c *config) setBodies(ctx *gin.Context, param *LogFormatterParams, req []byte, reqCut bool, resp []byte) {
+	switch {
+	case c.bodyLength <= 0:
+	case reqCut && len(c.redactKeys) > 0:
+		// a partial JSON document cannot be redacted, keep none of it
+		param.RequestData = fmt.Sprintf("request body exceeds read limit, limit size: %d", c.maxRequestBodyRead)
+	default:
+		req = c.redactBody(ctx.Request.Header.Get("Content-Type"), req)
+		if len(req) <= c.bodyLength {
+			param.RequestData = string(req)
+		} else {
+			param.RequestData = fmt.Sprintf("request data is too large, limit size: %d \n%s", c.bodyLength, string(req[0:c.bodyLength]))
+		}
+		if reqCut {
+			param.RequestData = cutRequestData(param.RequestData, c.maxRequestBodyRead)
+		}
+	}
+
+	if c.rawDataLength <= 0 {
+		return
+	}
+	cut := false
+	if c.decodeResponseBody {
+		resp, cut = decodeBody(ctx.Writer.Header().Get("Content-Encoding"), resp, c.rawDataLength)
+	}
+	if cut && len(c.redactKeys) > 0 {
+		// a partial JSON document cannot be redacted, keep none of it
+		param.ResponseData = fmt.Sprintf("response data is too large, limit size: %d", c.rawDataLength)
+		return
+	}
+	resp = c.redactBody(ctx.Writer.Header().Get("Content-Type"), resp)
+	if len(resp) <= c.rawDataLength {
+		param.ResponseData = string(resp)
+	} else {
+		param.ResponseData = fmt.Sprintf("response data is too large, limit size: %d \n%s", c.rawDataLength, string(resp[0:c.rawDataLength]))
+	}
+}
+
+// setResponseHash adds the "response_hash" field, the FNV-1a hash of a captured response body
+// no longer than WithRawDataLength.
+func (c *config) setResponseHash(param *LogFormatterParams, writer *bodyWriter) {
+	if writer.skip || writer.body.Len() > c.rawDataLength {
+		return
+	}
+	h := fnv.New64a()
+	h.Write(writer.body.Bytes())
+	param.setField("response_hash", strconv.FormatUint(h.Sum64(), 16))
+}
+
+// isPreflight reports a CORS preflight answered with a 2xx status.
+func isPreflight(c *gin.Context) bool {
+	if c.Request.Method != http.MethodOptions || c.Request.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	status := responseStatus(c.Writer)
+	return status >= http.StatusOK && status < http.StatusMultipleChoices
+}
+
+// RequestIDKey is the gin context key holding the request id generated by New.
+const RequestIDKey = "logger.request_id"
+
+// ensureRequestID generates a request id when neither the request nor an earlier requestid
+// middleware provided one, and echoes it on the response.
+func (c *config) ensureRequestID(ctx *gin.Context) {
+	if c.requestIDGenerator == nil || c.requestID(ctx) != "" {
+		return
+	}
+	id := c.requestIDGenerator()
+	ctx.Set(RequestIDKey, id)
+	ctx.Header(c.requestIDHeader, id)
+}
+
+// requestID returns the request id header of the request, or the one set on the response by
+// ensureRequestID or the requestid middleware.
+func (c *config) requestID(ctx *gin.Context) string {
+	if id := ctx.Request.Header.Get(c.requestIDHeader); id != "" {
+		return id
+	}
+	return ctx.Writer.Header().Get(c.requestIDHeader)
+}
+
+// setFields collects the configured extra structured fields into param.Fields.
+func (c *config) setFields(ctx *gin.Context, param *LogFormatterParams) {
+	if c.handlerStartKey != "" {
+		if handlerStart, ok := handlerStartTime(ctx, c.handlerStartKey); ok {
+			param.HandlerLatency = param.TimeStamp.Sub(handlerStart)
+			param.setField("total_latency", param.Latency)
+			param.setField("handler_latency", param.HandlerLatency)
+		}
+	}
+	if c.middlewareLatency {
+		if handlerStart, ok := handlerStartTime(ctx, HandlerStartKey); ok {
+			param.MiddlewareLatency = handlerStart.Sub(param.TimeStamp.Add(-param.Latency))
+			param.HandlerLatency = param.TimeStamp.Sub(handlerStart)
+			param.setField("middleware_latency", param.MiddlewareLatency)
+			param.setField("handler_latency", param.HandlerLatency)
+		}
+	}
+	for _, key := range c.counterKeys {
+		if value, ok := counterValue(ctx.Keys[key]); ok {
+			param.setField(key, value)
+		}
+	}
+	for _, key := range c.contextValueKeys {
+		if value := ctx.Request.Context().Value(key); value != nil {
+			param.setField(fmt.Sprint(key), value)
+		}
+	}
+	if c.baggageReader != nil {
+		for _, key := range c.baggageKeys {
+			if value, ok := c.baggageReader(ctx.Request.Context(), key); ok {
+				param.setField(key, value)
+			}
+		}
+	}
+}
+
+// setTrace fills TraceId and SpanId from the OpenTelemetry span of the request, then the
+// trace URL.
+func (c *config) setTrace(ctx *gin.Context, param *LogFormatterParams) {
+	if c.traceExtraction {
+		if sc := trace.SpanContextFromContext(ctx.Request.Context()); sc.IsValid() {
+			param.TraceId = sc.TraceID().String()
+			param.SpanId = sc.SpanID().String()
+		}
+	}
+	c.setTraceURL(param)
+}
+
+// setTraceURL adds the trace_url field built from WithTraceURLTemplate when a trace id is known.
+func (c *config) setTraceURL(param *LogFormatterParams) {
+	if c.traceURLTemplate == "" || param.TraceId == "" {
+		return
+	}
+	param.setField("trace_url", strings.ReplaceAll(c.traceURLTemplate, "{traceID}", url.PathEscape(param.TraceId)))
+}
+
+// HandlerStartKey is the c.Keys key under which MarkHandlerStart stores the time the handler
+// was reached.
+const HandlerStartKey = "logger.handler_start"
+
+// MarkHandlerStart returns a middleware recording when the request reaches the handler, for
+// WithMiddlewareLatency. Register it last, right before the handlers, with the logger first:
+//
+//	router.Use(logger.New(logger.WithMiddlewareLatency(true)), auth, rateLimit, logger.MarkHandlerStart())
+func MarkHandlerStart() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(HandlerStartKey, time.Now())
+	}
+}
+
+// handlerStartTime reads the time.Time stored under key in c.Keys or the request context.
+func handlerStartTime(c *gin.Context, key string) (time.Time, bool) {
+	value, ok := c.Get(key)
+	if !ok {
+		value = c.Request.Context().Value(key)
+	}
+	start, ok := value.(time.Time)
+	return start, ok && !start.IsZero()
+}
+
+func (p *LogFormatterParams) setField(key string, value interface{}) {
+	if p.Fields == nil {
+		p.Fields = make(map[string]interface{})
+	}
+	p.Fields[key] = value
+}
+
+// defaultMessage summarizes a request as "METHOD path status".
+func defaultMessage(param *LogFormatterParams) string {
+	return fmt.Sprintf("%s %s %d", param.Method, param.Path, param.StatusCode)
+}
+
+func (c *config) message(param *LogFormatterParams) string {
+	if c.messageFn != nil {
+		return c.messageFn(param)
+	}
+	return defaultMessage(param)
+}
+
+// captureBody reports whether the request and response bodies are captured for c.
+// With WithDebugHeader only requests presenting the secret are captured.
+func (c *config) captureBody(ctx *gin.Context) bool {
+	if c.debugHeader == "" && c.clientSampling == nil {
 		return true
 	}
-	for _, pattern := range patterns {
-		if pattern == "" {
+	if c.clientSampling != nil && c.clientSampling(ctx.ClientIP()) {
+		return true
+	}
+	if c.debugHeader == "" {
+		return false
+	}
+	value := ctx.Request.Header.Get(c.debugHeader)
+	return value != "" && subtle.ConstantTimeCompare([]byte(value), []byte(c.debugSecret)) == 1
+}
+
+// captureRequestBody reports whether the request body is buffered, going by its Content-Type.
+// Bodies sent without a Content-Type are captured.
+func (c *config) captureRequestBody(ctx *gin.Context) bool {
+	types := c.captureContentTypes
+	if len(c.requestContentTypes) > 0 {
+		types = c.requestContentTypes
+	}
+	contentType := ctx.Request.Header.Get("Content-Type")
+	return types == nil || contentType == "" || matchContentType(contentType, types)
+}
+
+// responseTypes returns the Content-Types of the response bodies captured.
+func (c *config) responseTypes() []string {
+	if len(c.responseContentTypes) > 0 {
+		return c.responseContentTypes
+	}
+	return c.captureContentTypes
+}
+
+// requestURL rebuilds the absolute URL of the request, honouring X-Forwarded-Proto
+// and masking the configured query parameters.
+func (c *config) requestURL(ctx *gin.Context) string {
+	scheme := "http"
+	if ctx.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := ctx.Request.Header.Get("X-Forwarded-Proto"); proto != "" {
+		proto, _, _ = strings.Cut(proto, ",")
+		scheme = strings.ToLower(strings.TrimSpace(proto))
+	}
+	u := scheme + "://" + ctx.Request.Host + ctx.Request.URL.EscapedPath()
+	if raw := ctx.Request.URL.RawQuery; raw != "" {
+		u = u + "?" + c.redactQuery(raw)
+	}
+	return u
+}
+
+// skipPath reports whether path is below one of the WithSkipPaths prefixes.
+func (c *config) skipPath(path string) bool {
+	for _, prefix := range c.skipPaths {
+		if strings.HasPrefix(path, prefix) && (len(path) == len(prefix) || path[len(prefix)] == '/' || strings.HasSuffix(prefix, "/")) {
 			return true
 		}
-		matched, err := regexp.MatchString(pattern, label)
-		if err != nil {
-			return true
+	}
+	return false
+}
+
+// apply applies opts and fills in the defaults depending on them.
+func (c *config) apply(opts []Option) {
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.formatter == nil {
+		c.formatter = defaultLogFormatter
+	}
+	if c.requestIDHeader == "" {
+		c.requestIDHeader = "X-Request-Id"
+	}
+	if c.stats == nil {
+		c.stats = &Stats{}
+	}
+	if c.sinkBreaker != nil {
+		c.sinkBreaker.stats = c.stats
+	}
+}
+
+// emit writes the access entry to the logger and the sink.
+func (c *config) emit(ctx context.Context, param *LogFormatterParams, logBodies bool) {
+	c.setSequence(param)
+	if c.logger != nil {
+		if logBodies {
+			c.logger.Debugf("Request : %s", param.RequestData)
+			c.logger.Debugf("Response: %s", param.ResponseData)
+		}
+		c.logf(param)("%s", c.formatter(*param))
+		if curl, ok := param.Fields["curl"].(string); ok && c.curlOnError {
+			c.logf(param)("reproduce with: %s", curl)
 		}
-		if matched {
+	} else if c.output != nil {
+		c.writeOutput(param)
+	}
+	c.writeSink(ctx, param)
+}
+
+// writeOutput writes the formatted entry as one line to WithOutput. Lines are written whole,
+// one at a time, so concurrent requests never interleave.
+func (c *config) writeOutput(param *LogFormatterParams) {
+	line := c.formatter(*param) + "\n"
+	c.outputMu.Lock()
+	defer c.outputMu.Unlock()
+	_, _ = io.WriteString(c.output, line)
+}
+
+// logf picks the level of the access line from its latency, see WithSlowThreshold.
+func (c *config) logf(param *LogFormatterParams) func(format string, args ...interface{}) {
+	level := c.statusLevel(param.StatusCode)
+	switch {
+	case c.verySlowThreshold > 0 && param.Latency >= c.verySlowThreshold:
+		level = min(level, glog.ErrorLevel)
+	case c.slowThreshold > 0 && param.Latency >= c.slowThreshold:
+		level = min(level, glog.WarnLevel)
+	}
+	switch {
+	case level <= glog.ErrorLevel:
+		// Panic and Fatal would stop the request, an access line never does
+		return c.logger.Errorf
+	case level == glog.WarnLevel:
+		return c.logger.Warnf
+	case level == glog.InfoLevel:
+		return c.logger.Infof
+	}
+	return c.logger.Debugf
+}
+
+// statusLevel maps a status code through WithStatusLevelMap, the exact code first, then its class.
+func (c *config) statusLevel(status int) glog.Level {
+	if level, ok := c.statusLevels[status]; ok {
+		return level
+	}
+	if level, ok := c.statusLevels[status/100]; ok {
+		return level
+	}
+	return glog.DebugLevel
+}
+
+func (c *config) setSequence(param *LogFormatterParams) {
+	if c.sequenceNumbers {
+		param.Sequence = c.sequence.Add(1)
+	}
+}
+
+func (c *config) writeSink(ctx context.Context, param *LogFormatterParams) {
+	if c.sink == nil {
+		return
+	}
+	if c.sinkBreaker != nil && !c.sinkBreaker.allow(time.Now()) {
+		return
+	}
+	err := c.sink.Write(ctx, *param)
+	if c.sinkBreaker != nil {
+		c.sinkBreaker.done(err, time.Now())
+	}
+	if err != nil && c.logger != nil {
+		c.logger.Warnf("log sink: %v", err)
+	}
+}
+
+// allowErrorLog applies WithErrorLogRateLimit to key, reporting the lines suppressed
+// since the previous allowed one.
+func (c *config) allowErrorLog(key string) bool {
+	if c.errorLimiter == nil {
+		return true
+	}
+	ok, suppressed := c.errorLimiter.allow(key, c.errorLimiter.now())
+	if ok && suppressed > 0 && c.logger != nil {
+		c.logger.Warnf("suppressed %d similar error log entries for %s", suppressed, key)
+	}
+	return ok
+}
+
+// responseStatus is the status sent for the response. Writers wrapping gin's may report 0
+// when the handler wrote nothing, net/http then answers 200.
+func responseStatus(w gin.ResponseWriter) int {
+	if status := w.Status(); status != 0 {
+		return status
+	}
+	return http.StatusOK
+}
+
+// setCallerInfo records the main handler of the route, where it is defined and the
+// names of the whole handler chain.
+func setCallerInfo(c *gin.Context, param *LogFormatterParams) {
+	param.HandlerName = c.HandlerName()
+	param.HandlerNames = c.HandlerNames()
+	if handler := c.Handler(); handler != nil {
+		if fn := runtime.FuncForPC(reflect.ValueOf(handler).Pointer()); fn != nil {
+			file, line := fn.FileLine(fn.Entry())
+			param.HandlerLocation = fmt.Sprintf("%s:%d", file, line)
+		}
+	}
+}
+
+// appStatus reads name from the response headers, falling back to a trailer
+// announced through the http.TrailerPrefix convention.
+func appStatus(header http.Header, name string) string {
+	if value := header.Get(name); value != "" {
+		return value
+	}
+	// "Trailer:" keys are not canonicalized by Header.Get, the name has to be
+	return header.Get(http.TrailerPrefix + http.CanonicalHeaderKey(name))
+}
+
+// errorChain walks the errors.Unwrap chain of err.
+func errorChain(err error) []string {
+	var chain []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		chain = append(chain, fmt.Sprintf("%T: %s", err, err.Error()))
+	}
+	return chain
+}
+
+// checkLabel returns false when label matches one of the exclude patterns.
+func (c *config) checkLabel(label string, patterns []*regexp.Regexp) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(label) {
 			return false
 		}
 	}
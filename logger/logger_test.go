@@ -0,0 +1,1857 @@
+package logger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/donetkit/contrib-log/glog"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func performRequest(r http.Handler, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+type recordSink struct {
+	entries []LogFormatterParams
+	err     error
+}
+
+func (s *recordSink) Write(_ context.Context, params LogFormatterParams) error {
+	s.entries = append(s.entries, params)
+	return s.err
+}
+
+func newTestRouter(opts ...Option) *gin.Engine {
+	router := gin.New()
+	router.Use(New(opts...))
+	router.GET("/ping", func(c *gin.Context) {
+		c.String(http.StatusOK, "pong")
+	})
+	return router
+}
+
+func TestSink(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink))
+
+	performRequest(router, "GET", "/ping?token=secret")
+	assert.Len(t, sink.entries, 1)
+	assert.Equal(t, http.StatusOK, sink.entries[0].StatusCode)
+	assert.Equal(t, "/ping?token=***", sink.entries[0].Path)
+	assert.Equal(t, "pong", sink.entries[0].ResponseData)
+	assert.Equal(t, "GET /ping?token=*** 200", sink.entries[0].Message)
+}
+
+func TestSinkBreaker(t *testing.T) {
+	sink := &recordSink{err: errors.New("broker down")}
+	stats := &Stats{}
+	router := newTestRouter(WithSink(sink), WithSinkBreaker(2, time.Hour), WithStats(stats))
+
+	for i := 0; i < 5; i++ {
+		performRequest(router, "GET", "/ping")
+	}
+	assert.Len(t, sink.entries, 2)
+	assert.True(t, stats.SinkBreakerOpen())
+	assert.Equal(t, int64(3), stats.SinkDropped())
+
+	now := time.Now()
+	b := newSinkBreaker(1, time.Second)
+	b.stats = &Stats{}
+	b.done(errors.New("timeout"), now)
+	assert.False(t, b.allow(now.Add(500*time.Millisecond)))
+	assert.True(t, b.allow(now.Add(time.Second)))
+	assert.False(t, b.allow(now.Add(time.Second)), "a single probe while half-open")
+	b.done(nil, now.Add(time.Second))
+	assert.False(t, b.stats.SinkBreakerOpen())
+	assert.True(t, b.allow(now.Add(time.Second)))
+}
+
+func TestInstrument(t *testing.T) {
+	var got LogFormatterParams
+	router := gin.New()
+	router.Use(Instrument(func(p LogFormatterParams) { got = p }))
+	router.GET("/ping", func(c *gin.Context) {
+		c.String(http.StatusTeapot, "pong")
+	})
+
+	performRequest(router, "GET", "/ping?x=1")
+	assert.Equal(t, http.StatusTeapot, got.StatusCode)
+	assert.Equal(t, "GET", got.Method)
+	assert.Equal(t, "/ping", got.Path)
+	assert.Equal(t, 4, got.BodySize)
+	assert.Empty(t, got.ResponseData)
+}
+
+func BenchmarkInstrument(b *testing.B) {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(Instrument(func(LogFormatterParams) {}))
+	router.GET("/ping", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	req := httptest.NewRequest("GET", "/ping", nil)
+	w := httptest.NewRecorder()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		router.ServeHTTP(w, req)
+	}
+}
+
+func TestFormatterRegistry(t *testing.T) {
+	_, err := LookupFormatter("default")
+	assert.NoError(t, err)
+
+	_, err = LookupFormatter("unknown")
+	assert.Error(t, err)
+	assert.Panics(t, func() { WithFormatterName("unknown") })
+
+	RegisterFormatter("status", func(p LogFormatterParams) string { return http.StatusText(p.StatusCode) })
+	f, err := LookupFormatter("status")
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", f(LogFormatterParams{StatusCode: http.StatusOK}))
+}
+
+func TestErrorChain(t *testing.T) {
+	base := errors.New("boom")
+	err := fmt.Errorf("handler: %w", base)
+	assert.Equal(t, []string{"*fmt.wrapError: handler: boom", "*errors.errorString: boom"}, errorChain(err))
+	assert.Nil(t, errorChain(nil))
+}
+
+func TestCaptureBodyDebugHeader(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+
+	cfg := &config{}
+	assert.True(t, cfg.captureBody(c))
+
+	WithDebugHeader("X-Debug-Log", "0123456789abcdef")(cfg)
+	assert.False(t, cfg.captureBody(c))
+
+	c.Request.Header.Set("X-Debug-Log", "wrong")
+	assert.False(t, cfg.captureBody(c))
+
+	c.Request.Header.Set("X-Debug-Log", "0123456789abcdef")
+	assert.True(t, cfg.captureBody(c))
+
+	assert.Panics(t, func() { WithDebugHeader("X-Debug-Log", "short") })
+}
+
+func TestClientSampling(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithClientSampling(func(ip string) bool {
+		return ip == "10.0.0.66"
+	}))
+	for _, addr := range []string{"10.0.0.1:1234", "10.0.0.66:1234"} {
+		req := httptest.NewRequest("GET", "/ping", nil)
+		req.RemoteAddr = addr
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	assert.Len(t, sink.entries, 2)
+	assert.Empty(t, sink.entries[0].ResponseData)
+	assert.Equal(t, "pong", sink.entries[1].ResponseData)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/", nil)
+	c.Request.RemoteAddr = "10.0.0.1:1234"
+	cfg := &config{}
+	WithClientSampling(func(ip string) bool { return false })(cfg)
+	WithDebugHeader("X-Debug-Log", "0123456789abcdef")(cfg)
+	assert.False(t, cfg.captureBody(c))
+	c.Request.Header.Set("X-Debug-Log", "0123456789abcdef")
+	assert.True(t, cfg.captureBody(c))
+}
+
+var formatterParams = LogFormatterParams{
+	StatusCode:   http.StatusOK,
+	Latency:      1234567 * time.Nanosecond,
+	ClientIP:     "192.168.1.10",
+	Method:       "GET",
+	Path:         "/api/v1/users?id=1",
+	ErrorMessage: "",
+}
+
+func TestFastTextFormatter(t *testing.T) {
+	assert.Equal(t, defaultLogFormatter(formatterParams), FastTextFormatter(formatterParams))
+
+	p := formatterParams
+	p.StatusCode = 500
+	p.Latency = 42 * time.Microsecond
+	p.Method = "OPTIONS"
+	p.ErrorMessage = "Error #01: boom\n"
+	assert.Equal(t, defaultLogFormatter(p), FastTextFormatter(p))
+
+	p.Latency = 90*time.Second + 300*time.Millisecond
+	assert.Equal(t, defaultLogFormatter(p), FastTextFormatter(p))
+
+	// fields overflowing the pooled buffer
+	p.Prefix = strings.Repeat("p", 240)
+	p.ClientIP = strings.Repeat("1", 300)
+	p.Latency = 1234*time.Hour + 56*time.Minute + 7890*time.Millisecond
+	assert.Equal(t, defaultLogFormatter(p), FastTextFormatter(p))
+	p.Prefix = strings.Repeat("p", 254)
+	p.ClientIP = "10.0.0.1"
+	assert.Equal(t, defaultLogFormatter(p), FastTextFormatter(p))
+}
+
+func BenchmarkDefaultLogFormatter(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		defaultLogFormatter(formatterParams)
+	}
+}
+
+func BenchmarkFastTextFormatter(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		FastTextFormatter(formatterParams)
+	}
+}
+
+func TestAppendDuration(t *testing.T) {
+	for _, d := range []time.Duration{
+		0, 999, time.Microsecond, 1500 * time.Microsecond, time.Second,
+		90 * time.Second, time.Hour, time.Hour + 2*time.Minute + 3*time.Second,
+	} {
+		assert.Equal(t, d.String(), string(appendDuration(nil, d)))
+	}
+}
+
+func TestCounterKeys(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithCounterKeys([]string{"db.queries", "cache.ratio", "hits", "name", "missing"}))
+	router.GET("/counters", func(c *gin.Context) {
+		hits := &atomic.Int64{}
+		hits.Add(3)
+		c.Set("db.queries", 7)
+		c.Set("cache.ratio", float32(0.5))
+		c.Set("hits", hits)
+		c.Set("name", "12")
+		c.Status(http.StatusOK)
+	})
+
+	performRequest(router, "GET", "/counters")
+	assert.Equal(t, map[string]interface{}{
+		"db.queries":  int64(7),
+		"cache.ratio": float64(0.5),
+		"hits":        int64(3),
+	}, sink.entries[0].Fields)
+}
+
+func TestECSFormatter(t *testing.T) {
+	p := formatterParams
+	p.TimeStamp = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	p.TraceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	p.BodySize = 12
+
+	var out map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(ECSFormatter(p)), &out))
+	assert.Equal(t, "2024-01-02T03:04:05Z", out["@timestamp"])
+	assert.Equal(t, "GET", gjson.Get(ECSFormatter(p), "http.request.method").String())
+	assert.Equal(t, int64(200), gjson.Get(ECSFormatter(p), "http.response.status_code").Int())
+	assert.Equal(t, int64(12), gjson.Get(ECSFormatter(p), "http.response.body.bytes").Int())
+	assert.Equal(t, "/api/v1/users", gjson.Get(ECSFormatter(p), "url.path").String())
+	assert.Equal(t, "id=1", gjson.Get(ECSFormatter(p), "url.query").String())
+	assert.Equal(t, "192.168.1.10", gjson.Get(ECSFormatter(p), "client.ip").String())
+	assert.Equal(t, int64(1234567), gjson.Get(ECSFormatter(p), "event.duration").Int())
+	assert.Equal(t, p.TraceId, gjson.Get(ECSFormatter(p), "trace.id").String())
+	assert.False(t, gjson.Get(ECSFormatter(p), "span").Exists())
+	assert.False(t, gjson.Get(ECSFormatter(p), "error").Exists())
+}
+
+func TestECSRequestFields(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink))
+	req := httptest.NewRequest("GET", "/ping", nil)
+	req.Header.Set("User-Agent", "probe/1.0")
+	req.Header.Set("Referer", "https://example.com/dashboard")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	line := ECSFormatter(sink.entries[0])
+	assert.Equal(t, "1.1", gjson.Get(line, "http.version").String())
+	assert.Equal(t, "probe/1.0", gjson.Get(line, "user_agent.original").String())
+	assert.Equal(t, "https://example.com/dashboard", gjson.Get(line, "http.request.referrer").String())
+}
+
+func TestInFlightLimit(t *testing.T) {
+	stats := &Stats{}
+	release := make(chan struct{})
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.Use(New(WithInFlightLimit(1, 1), WithStats(stats)))
+	router.GET("/slow", func(c *gin.Context) {
+		<-release
+		c.Status(http.StatusOK)
+	})
+	router.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	done := make(chan int)
+	go func() {
+		done <- performRequest(router, "GET", "/slow").Code
+	}()
+	assert.Eventually(t, func() bool { return stats.InFlight() == 1 }, time.Second, time.Millisecond)
+
+	w := performRequest(router, "GET", "/slow")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, int64(1), stats.InFlightRejected())
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, int64(0), stats.InFlight())
+
+	w = performRequest(router, "GET", "/panic")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, int64(0), stats.InFlight())
+}
+
+// zeroStatusWriter mimics a third-party writer that only knows the status once WriteHeader is called.
+type zeroStatusWriter struct {
+	gin.ResponseWriter
+	status int
+}
+
+func (w *zeroStatusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *zeroStatusWriter) Status() int {
+	return w.status
+}
+
+func TestImplicitStatus(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink))
+	router.GET("/empty", func(c *gin.Context) {})
+	router.GET("/header", func(c *gin.Context) {
+		c.Header("X-Only", "1")
+	})
+	router.GET("/wrapped", func(c *gin.Context) {
+		c.Writer = &zeroStatusWriter{ResponseWriter: c.Writer}
+	})
+
+	for _, path := range []string{"/empty", "/header", "/wrapped"} {
+		w := performRequest(router, "GET", path)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.Len(t, sink.entries, 3)
+	for _, entry := range sink.entries {
+		assert.Equal(t, http.StatusOK, entry.StatusCode, entry.Path)
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithSequenceNumbers(true))
+	for i := 0; i < 3; i++ {
+		performRequest(router, "GET", "/ping")
+	}
+	assert.Len(t, sink.entries, 3)
+	for i, entry := range sink.entries {
+		assert.Equal(t, uint64(i+1), entry.Sequence)
+	}
+	assert.Equal(t, int64(3), gjson.Get(ECSFormatter(sink.entries[2]), "event.sequence").Int())
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink))
+	performRequest(router, "GET", "/ping")
+	assert.Zero(t, sink.entries[0].Sequence)
+	assert.False(t, gjson.Get(ECSFormatter(sink.entries[0]), "event.sequence").Exists())
+}
+
+func TestBodySink(t *testing.T) {
+	type bodies struct {
+		id        string
+		req, resp []byte
+	}
+	var got []bodies
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithBodySink(func(requestID string, req, resp []byte) {
+		got = append(got, bodies{requestID, req, resp})
+	}))
+	router.POST("/echo", func(c *gin.Context) {
+		data, _ := c.GetRawData()
+		c.String(http.StatusOK, "echo: %s", data)
+	})
+
+	req := httptest.NewRequest("POST", "/echo", strings.NewReader(`{"card":"4111"}`))
+	req.Header.Set("X-Request-Id", "req-1")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Len(t, got, 1)
+	assert.Equal(t, "req-1", got[0].id)
+	assert.Equal(t, `{"card":"4111"}`, string(got[0].req))
+	assert.Equal(t, `echo: {"card":"4111"}`, string(got[0].resp))
+	assert.Len(t, sink.entries, 1)
+	assert.Equal(t, "req-1", sink.entries[0].RequestId)
+	assert.Empty(t, sink.entries[0].RequestData)
+	assert.Empty(t, sink.entries[0].ResponseData)
+}
+
+func TestHandlerStartKey(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithHandlerStartKey("handler.start"))
+	router.GET("/auth", func(c *gin.Context) {
+		time.Sleep(5 * time.Millisecond)
+		c.Set("handler.start", time.Now())
+	}, func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	performRequest(router, "GET", "/auth")
+	performRequest(router, "GET", "/ping")
+	assert.Len(t, sink.entries, 2)
+
+	entry := sink.entries[0]
+	assert.Less(t, entry.HandlerLatency, 5*time.Millisecond)
+	assert.GreaterOrEqual(t, entry.Latency, 5*time.Millisecond)
+	assert.Equal(t, entry.Latency, entry.Fields["total_latency"])
+	assert.Equal(t, entry.HandlerLatency, entry.Fields["handler_latency"])
+
+	assert.Zero(t, sink.entries[1].HandlerLatency)
+	assert.NotContains(t, sink.entries[1].Fields, "handler_latency")
+}
+
+func TestInstancesDoNotShareConfig(t *testing.T) {
+	full, truncated := &recordSink{}, &recordSink{}
+	router := gin.New()
+	echo := func(c *gin.Context) {
+		data, _ := c.GetRawData()
+		c.String(http.StatusOK, "%s", data)
+	}
+	router.POST("/admin", New(WithSink(full), WithBodyLength(1024)), echo)
+	router.POST("/public", New(WithSink(truncated), WithBodyLength(4)), echo)
+
+	body := "0123456789"
+	for _, path := range []string{"/admin", "/public", "/admin"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", path, strings.NewReader(body)))
+	}
+
+	assert.Len(t, full.entries, 2)
+	assert.Len(t, truncated.entries, 1)
+	for _, entry := range full.entries {
+		assert.Equal(t, body, entry.RequestData)
+	}
+	assert.NotEqual(t, body, truncated.entries[0].RequestData)
+}
+
+func TestLoggedErrorTypes(t *testing.T) {
+	handler := func(c *gin.Context) {
+		_ = c.Error(errors.New("db timeout"))
+		_ = c.Error(errors.New("name is required")).SetType(gin.ErrorTypeBind)
+		c.Status(http.StatusBadRequest)
+	}
+
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink))
+	router.GET("/bind", handler)
+	performRequest(router, "GET", "/bind")
+	assert.Equal(t, "Error #01: db timeout\n", sink.entries[0].ErrorMessage)
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithLoggedErrorTypes(gin.ErrorTypePrivate|gin.ErrorTypeBind))
+	router.GET("/bind", handler)
+	performRequest(router, "GET", "/bind")
+	assert.Equal(t, "Error #01: db timeout\nError #02: name is required\n", sink.entries[0].ErrorMessage)
+}
+
+func TestRequestDataTooLarge(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithBodyLength(1024))
+	router.POST("/upload", func(c *gin.Context) {
+		c.String(http.StatusOK, "stored")
+	})
+
+	body := strings.Repeat("x", 1<<20)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader(body)))
+
+	assert.Len(t, sink.entries, 1)
+	assert.True(t, strings.HasPrefix(sink.entries[0].RequestData, "request data is too large, limit size: 1024 \n"))
+	assert.Len(t, sink.entries[0].RequestData, len("request data is too large, limit size: 1024 \n")+1024)
+	assert.Equal(t, "stored", sink.entries[0].ResponseData)
+}
+
+func TestJSONFormatter(t *testing.T) {
+	p := formatterParams
+	p.TimeStamp = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	p.BodySize = 42
+	p.RequestId = "req-1"
+
+	assert.Equal(t,
+		`{"timestamp":"2024-01-02T03:04:05Z","status":200,"latency_ms":1,"client_ip":"192.168.1.10","method":"GET","path":"/api/v1/users?id=1","request_id":"req-1","body_size":42}`,
+		JSONFormatter(p))
+
+	p.TraceId = "abc"
+	p.ErrorMessage = "boom"
+	p.Fields = map[string]interface{}{"bad": make(chan int)}
+	out := JSONFormatter(p)
+	assert.Equal(t, "abc", gjson.Get(out, "trace_id").String())
+	assert.Equal(t, "boom", gjson.Get(out, "error").String())
+	assert.False(t, gjson.Get(out, "fields").Exists())
+
+	f, err := LookupFormatter("json")
+	assert.NoError(t, err)
+	assert.Equal(t, JSONFormatter(formatterParams), f(formatterParams))
+}
+
+type tenantKey struct{}
+
+func (tenantKey) String() string { return "tenant" }
+
+func TestContextValueKeys(t *testing.T) {
+	sink := &recordSink{}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		ctx := context.WithValue(c.Request.Context(), tenantKey{}, "acme")
+		c.Request = c.Request.WithContext(context.WithValue(ctx, "user_id", 42))
+	})
+	router.Use(New(WithSink(sink), WithContextValueKeys([]interface{}{tenantKey{}, "user_id", "missing"})))
+	router.GET("/ping", func(c *gin.Context) {})
+
+	performRequest(router, "GET", "/ping")
+	assert.Equal(t, map[string]interface{}{"tenant": "acme", "user_id": 42}, sink.entries[0].Fields)
+}
+
+func TestSkipPaths(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithSkipPaths([]string{"/healthz", "/static/"}))
+	var body string
+	for _, path := range []string{"/healthz", "/healthz/ready", "/static/app.js", "/healthzz", "/ping"} {
+		router.POST(path, func(c *gin.Context) {
+			data, _ := io.ReadAll(c.Request.Body)
+			body = string(data)
+		})
+	}
+
+	for _, path := range []string{"/healthz", "/healthz/ready", "/static/app.js"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader("payload"))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		assert.Equal(t, "payload", body)
+	}
+	assert.Empty(t, sink.entries)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/healthzz", nil))
+	assert.Len(t, sink.entries, 1)
+
+	router = gin.New()
+	router.Use(New(WithSink(sink), WithSkipPaths([]string{"/healthz"})))
+	router.GET("/healthz", func(c *gin.Context) {})
+	w, req := httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil)
+	assert.Zero(t, testing.AllocsPerRun(100, func() { router.ServeHTTP(w, req) }))
+}
+
+func BenchmarkSkipPaths(b *testing.B) {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(New(WithSink(&recordSink{}), WithSkipPaths([]string{"/metrics", "/static", "/healthz"})))
+	router.GET("/healthz", func(c *gin.Context) {})
+	w, req := httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		router.ServeHTTP(w, req)
+	}
+}
+
+func TestExcludeRegex(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithExcludeRegexEndpoint([]string{"^/internal/", "", "^/ping$"}), WithExcludeRegexMethod([]string{"^HEAD$"}))
+	router.GET("/internal/debug", func(c *gin.Context) {})
+
+	performRequest(router, "GET", "/internal/debug")
+	performRequest(router, "HEAD", "/ping")
+	performRequest(router, "GET", "/ping")
+	assert.Len(t, sink.entries, 1)
+	assert.Equal(t, "/ping", sink.entries[0].Path)
+
+	assert.PanicsWithValue(t, "logger: invalid exclude pattern: error parsing regexp: missing closing ): `(`", func() {
+		WithExcludeRegexStatus([]string{"("})
+	})
+}
+
+func BenchmarkCheckLabel(b *testing.B) {
+	patterns := []string{"^/healthz$", "^/metrics", "^/static/.*"}
+	label := "/api/v1/users"
+	b.Run("per-request", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, pattern := range patterns {
+				if matched, _ := regexp.MatchString(pattern, label); matched {
+					break
+				}
+			}
+		}
+	})
+	b.Run("precompiled", func(b *testing.B) {
+		cfg := &config{}
+		compiled := compilePatterns(patterns)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			cfg.checkLabel(label, compiled)
+		}
+	})
+}
+
+func TestPrefix(t *testing.T) {
+	p := formatterParams
+	assert.False(t, strings.HasPrefix(defaultLogFormatter(p), "["))
+	assert.False(t, gjson.Get(JSONFormatter(p), "logger").Exists())
+
+	p.Prefix = "[access]"
+	assert.Equal(t, "[access] "+defaultLogFormatter(formatterParams), defaultLogFormatter(p))
+	assert.Equal(t, defaultLogFormatter(p), FastTextFormatter(p))
+	assert.Equal(t, "[access]", gjson.Get(JSONFormatter(p), "logger").String())
+	assert.Equal(t, "[access]", gjson.Get(ECSFormatter(p), "log.logger").String())
+
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithPrefix("[access]"))
+	performRequest(router, "GET", "/ping")
+	assert.Equal(t, "[access]", sink.entries[0].Prefix)
+}
+
+// hookLogger is a glog.ILogger whose entries are recorded by a logrus test hook.
+type hookLogger struct {
+	glog.ILogger
+	logger *logrus.Logger
+}
+
+func (l hookLogger) WithField(key string, value interface{}) *logrus.Entry {
+	return l.logger.WithField(key, value)
+}
+
+func newHookLogger() (glog.ILogger, *logrustest.Hook) {
+	logger, hook := logrustest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	return hookLogger{logger: logger}, hook
+}
+
+func TestSlowThreshold(t *testing.T) {
+	log, hook := newHookLogger()
+	router := newTestRouter(WithLogger(log), WithSlowThreshold(20*time.Millisecond), WithVerySlowThreshold(40*time.Millisecond))
+	for _, d := range []time.Duration{0, 20 * time.Millisecond, 40 * time.Millisecond} {
+		d := d
+		router.GET(fmt.Sprintf("/sleep/%d", d.Milliseconds()), func(c *gin.Context) {
+			time.Sleep(d)
+		})
+	}
+
+	var levels []logrus.Level
+	for _, path := range []string{"/sleep/0", "/sleep/20", "/sleep/40"} {
+		hook.Reset()
+		performRequest(router, "GET", path)
+		levels = append(levels, hook.LastEntry().Level)
+	}
+	assert.Equal(t, []logrus.Level{logrus.DebugLevel, logrus.WarnLevel, logrus.ErrorLevel}, levels)
+
+	hook.Reset()
+	performRequest(newTestRouter(WithLogger(log)), "GET", "/ping")
+	assert.Equal(t, logrus.DebugLevel, hook.LastEntry().Level)
+}
+
+func TestRedactKeys(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithRedactKeys([]string{"Password", "token"}), WithBodyLength(40))
+	router.POST("/login", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"token": "abc.def", "user": gin.H{"id": 1}})
+	})
+	post := func(contentType, body string) LogFormatterParams {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		return sink.entries[len(sink.entries)-1]
+	}
+
+	entry := post("application/json", `{"user":"bob","devices":[{"PASSWORD":"hunter2","n":1.50}],"note":"a long note to truncate"}`)
+	assert.NotContains(t, entry.RequestData, "hunter2")
+	assert.True(t, strings.HasPrefix(entry.RequestData, "request data is too large, limit size: 40 \n"))
+	assert.Contains(t, entry.RequestData, `{"devices":[{"PASSWORD":"***","n":1.50}]`)
+	assert.Equal(t, `{"token":"***","user":{"id":1}}`, entry.ResponseData)
+
+	entry = post("text/plain", `password=hunter2`)
+	assert.Equal(t, `password=hunter2`, entry.RequestData)
+
+	entry = post("application/json", `{"password":`)
+	assert.Equal(t, `{"password":`, entry.RequestData)
+}
+
+func TestTraceURLTemplate(t *testing.T) {
+	cfg := &config{}
+	WithTraceURLTemplate("https://jaeger.example.com/trace/{traceID}")(cfg)
+
+	param := LogFormatterParams{}
+	cfg.setTraceURL(&param)
+	assert.Nil(t, param.Fields)
+
+	param.TraceId = "4bf92f3577b34da6a3ce929d0e0e4736"
+	cfg.setTraceURL(&param)
+	assert.Equal(t, "https://jaeger.example.com/trace/4bf92f3577b34da6a3ce929d0e0e4736", param.Fields["trace_url"])
+}
+
+func TestCaptureContentTypes(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n binary")
+	routes := func(router *gin.Engine) {
+		router.GET("/image", func(c *gin.Context) {
+			c.Data(http.StatusOK, "image/png", png)
+		})
+		router.GET("/problem", func(c *gin.Context) {
+			c.Data(http.StatusBadRequest, "application/problem+json; charset=utf-8", []byte(`{"title":"bad"}`))
+		})
+		router.GET("/sniffed", func(c *gin.Context) {
+			_, _ = c.Writer.WriteString("<html>hi</html>")
+		})
+	}
+
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink))
+	routes(router)
+	for _, path := range []string{"/image", "/problem", "/sniffed"} {
+		performRequest(router, "GET", path)
+	}
+	assert.Empty(t, sink.entries[0].ResponseData)
+	assert.Equal(t, len(png), sink.entries[0].BodySize)
+	assert.Equal(t, `{"title":"bad"}`, sink.entries[1].ResponseData)
+	assert.Equal(t, "<html>hi</html>", sink.entries[2].ResponseData)
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithCaptureContentTypes(nil))
+	routes(router)
+	performRequest(router, "GET", "/image")
+	assert.Equal(t, string(png), sink.entries[0].ResponseData)
+}
+
+func TestRequestIDGenerator(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithRequestIDGenerator(func() string { return "gen-1" }))
+	var seen string
+	router.GET("/id", func(c *gin.Context) {
+		seen = c.GetString(RequestIDKey)
+	})
+
+	w := performRequest(router, "GET", "/id")
+	assert.Equal(t, "gen-1", seen)
+	assert.Equal(t, "gen-1", w.Header().Get("X-Request-Id"))
+	assert.Equal(t, "gen-1", sink.entries[0].RequestId)
+
+	// an incoming id is kept and not echoed
+	req := httptest.NewRequest("GET", "/ping", nil)
+	req.Header.Set("X-Request-Id", "client-1")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Empty(t, w.Header().Get("X-Request-Id"))
+	assert.Equal(t, "client-1", sink.entries[1].RequestId)
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithRequestIDHeader("X-Correlation-Id"))
+	w = performRequest(router, "GET", "/ping")
+	assert.Len(t, w.Header().Get("X-Correlation-Id"), 32)
+	assert.Empty(t, w.Header().Get("X-Request-Id"))
+	assert.Equal(t, w.Header().Get("X-Correlation-Id"), sink.entries[0].RequestId)
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithRequestIDGenerator(nil))
+	w = performRequest(router, "GET", "/ping")
+	assert.Empty(t, w.Header().Get("X-Request-Id"))
+	assert.Empty(t, sink.entries[0].RequestId)
+}
+
+func TestSkipPreflight(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithSkipPreflight(true))
+	router.OPTIONS("/api", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	router.OPTIONS("/denied", func(c *gin.Context) {
+		c.Status(http.StatusForbidden)
+	})
+	preflight := func(path string) {
+		req := httptest.NewRequest("OPTIONS", path, nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	preflight("/api")
+	assert.Empty(t, sink.entries)
+
+	preflight("/denied")
+	performRequest(router, "OPTIONS", "/api")
+	assert.Len(t, sink.entries, 2)
+	assert.Equal(t, http.StatusForbidden, sink.entries[0].StatusCode)
+	assert.Equal(t, "/api", sink.entries[1].Path)
+}
+
+func TestTraceExtraction(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled})
+
+	sink := &recordSink{}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		if c.Query("span") != "" {
+			c.Request = c.Request.WithContext(trace.ContextWithSpanContext(c.Request.Context(), sc))
+		}
+	})
+	router.Use(New(WithSink(sink), WithTraceExtraction(true), WithTraceURLTemplate("https://jaeger.example.com/trace/{traceID}")))
+	router.GET("/ping", func(c *gin.Context) {})
+
+	performRequest(router, "GET", "/ping?span=1")
+	performRequest(router, "GET", "/ping")
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sink.entries[0].TraceId)
+	assert.Equal(t, "00f067aa0ba902b7", sink.entries[0].SpanId)
+	assert.Equal(t, "https://jaeger.example.com/trace/4bf92f3577b34da6a3ce929d0e0e4736", sink.entries[0].Fields["trace_url"])
+	assert.Empty(t, sink.entries[1].TraceId)
+	assert.Empty(t, sink.entries[1].SpanId)
+
+	out := gjson.Parse(JSONFormatter(sink.entries[1]))
+	assert.False(t, out.Get("trace_id").Exists())
+}
+
+func TestDecodeResponseBody(t *testing.T) {
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write([]byte(s))
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	deflated := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		_, _ = zw.Write([]byte(s))
+		_ = zw.Close()
+		return buf.Bytes()
+	}
+	routes := func(router *gin.Engine) {
+		router.GET("/gzip", func(c *gin.Context) {
+			c.Header("Content-Encoding", "gzip")
+			c.Data(http.StatusOK, "application/json", gzipped(`{"token":"abc","name":"gopher"}`))
+		})
+		router.GET("/deflate", func(c *gin.Context) {
+			c.Header("Content-Encoding", "deflate")
+			c.Data(http.StatusOK, "text/plain", deflated("hello"))
+		})
+		router.GET("/bomb", func(c *gin.Context) {
+			c.Header("Content-Encoding", "gzip")
+			c.Data(http.StatusOK, "application/json", gzipped(`{"token":"abc","data":"`+strings.Repeat("a", 1<<20)+`"}`))
+		})
+	}
+
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithDecodeResponseBody(true), WithRawDataLength(64), WithRedactKeys([]string{"token"}))
+	routes(router)
+	for _, path := range []string{"/gzip", "/deflate", "/bomb"} {
+		performRequest(router, "GET", path)
+	}
+	assert.JSONEq(t, `{"token":"***","name":"gopher"}`, sink.entries[0].ResponseData)
+	assert.Equal(t, "hello", sink.entries[1].ResponseData)
+	assert.Equal(t, "response data is too large, limit size: 64", sink.entries[2].ResponseData)
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithDecodeResponseBody(true), WithRawDataLength(16))
+	routes(router)
+	performRequest(router, "GET", "/bomb")
+	assert.Equal(t, "response data is too large, limit size: 16 \n{\"token\":\"abc\",\"", sink.entries[0].ResponseData)
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink))
+	routes(router)
+	performRequest(router, "GET", "/deflate")
+	assert.Equal(t, string(deflated("hello")), sink.entries[0].ResponseData)
+}
+
+func TestResponseETagHash(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithResponseETagHash(true), WithRawDataLength(8))
+	router.GET("/large", func(c *gin.Context) {
+		c.String(http.StatusOK, "larger than eight bytes")
+	})
+	router.GET("/image", func(c *gin.Context) {
+		c.Data(http.StatusOK, "image/png", []byte("png"))
+	})
+
+	performRequest(router, "GET", "/ping")
+	performRequest(router, "GET", "/ping")
+	performRequest(router, "GET", "/large")
+	performRequest(router, "GET", "/image")
+	assert.Equal(t, "8c1eda0da8870097", sink.entries[0].Fields["response_hash"])
+	assert.Equal(t, sink.entries[0].Fields["response_hash"], sink.entries[1].Fields["response_hash"])
+	assert.NotContains(t, sink.entries[2].Fields, "response_hash")
+	assert.NotContains(t, sink.entries[3].Fields, "response_hash")
+}
+
+func TestErrorLoggerBodyLimitDefaults(t *testing.T) {
+	log, _ := newHookLogger()
+	panics := func(c *gin.Context) { panic("boom") }
+	post := func(router *gin.Engine, path string) {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", path, strings.NewReader("hello")))
+	}
+
+	sink := &recordSink{}
+	router := gin.New()
+	router.POST("/default", NewErrorLogger(WithLogger(log), WithSink(sink)), panics)
+	router.POST("/limited", NewErrorLogger(WithLogger(log), WithSink(sink), WithRequestBodyLimit(3)), panics)
+	router.POST("/none", NewErrorLogger(WithLogger(log), WithSink(sink), WithRequestBodyLimit(0)), panics)
+	post(router, "/default")
+	post(router, "/limited")
+	post(router, "/none")
+	assert.Len(t, sink.entries, 3)
+	assert.Equal(t, "hello", sink.entries[0].RequestData)
+	assert.Equal(t, "request data is too large, limit size: 3 \nhel", sink.entries[1].RequestData)
+	assert.Empty(t, sink.entries[2].RequestData)
+}
+
+func TestResponseBodyLimit(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithResponseBodyLimit(2))
+	performRequest(router, "GET", "/ping")
+	assert.Equal(t, "response data is too large, limit size: 2 \npo", sink.entries[0].ResponseData)
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithResponseBodyLimit(0))
+	performRequest(router, "GET", "/ping")
+	assert.Empty(t, sink.entries[0].ResponseData)
+}
+
+func TestErrorLoggerPanicResponse(t *testing.T) {
+	log, hook := newHookLogger()
+	router := gin.New()
+	router.GET("/default", NewErrorLogger(WithLogger(log)), func(c *gin.Context) { panic("db password is hunter2") })
+	router.GET("/exposed", NewErrorLogger(WithLogger(log), WithExposePanicMessage(true)), func(c *gin.Context) { panic("boom") })
+	router.GET("/custom", NewErrorLogger(WithLogger(log), WithWriterErrorFn(func(c *gin.Context, param *LogFormatterParams) (int, interface{}) {
+		return http.StatusServiceUnavailable, gin.H{"retry": true}
+	})), func(c *gin.Context) { panic("boom") })
+
+	req := httptest.NewRequest("GET", "/default", nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"code":500,"message":"internal server error","request_id":"req-1"}`, w.Body.String())
+	assert.NotContains(t, w.Body.String(), "hunter2")
+	assert.Contains(t, hook.LastEntry().Message, "hunter2")
+
+	w = performRequest(router, "GET", "/exposed")
+	assert.Equal(t, "boom", gjson.Get(w.Body.String(), "message").String())
+
+	w = performRequest(router, "GET", "/custom")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.JSONEq(t, `{"retry":true}`, w.Body.String())
+
+	// the client gets the error response even when nothing is logged
+	sink := &recordSink{}
+	router = gin.New()
+	router.GET("/nologger", NewErrorLogger(), func(c *gin.Context) { panic("boom") })
+	router.GET("/excluded", NewErrorLogger(WithSink(sink), WithExcludeRegexEndpoint([]string{"^/excluded$"})), func(c *gin.Context) { panic("boom") })
+	for _, path := range []string{"/nologger", "/excluded"} {
+		w = performRequest(router, "GET", path)
+		assert.Equal(t, http.StatusInternalServerError, w.Code, path)
+		assert.Equal(t, "internal server error", gjson.Get(w.Body.String(), "message").String(), path)
+	}
+	assert.Empty(t, sink.entries)
+}
+
+func TestFileSink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	sink, err := NewFileSink(path, 1, 2)
+	assert.NoError(t, err)
+	sink.maxSize = 300
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	router := newTestRouter(WithSink(sink))
+	for i := 0; i < 10; i++ {
+		performRequest(router, "GET", "/ping")
+	}
+	backups, err := sink.backups()
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+	for _, file := range append(backups, path) {
+		data, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(data), 300)
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			assert.Equal(t, "/ping", gjson.Get(line, "path").String())
+		}
+	}
+
+	// a new day starts a new file whatever its size
+	now = now.Add(24 * time.Hour)
+	performRequest(router, "GET", "/ping")
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, 1, strings.Count(string(data), "\n"))
+
+	assert.NoError(t, sink.Flush())
+	assert.NoError(t, sink.Close())
+	assert.ErrorIs(t, sink.Write(context.Background(), LogFormatterParams{}), os.ErrClosed)
+}
+
+func TestFileSinkSameTimeRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	sink, err := NewFileSink(path, 1, 0)
+	assert.NoError(t, err)
+	sink.maxSize = 1
+	// every rotation happens within the same millisecond
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time { return now }
+
+	for i := 0; i < 12; i++ {
+		assert.NoError(t, sink.Write(context.Background(), LogFormatterParams{Path: "/" + strconv.Itoa(i)}))
+	}
+	assert.NoError(t, sink.Close())
+
+	backups, err := sink.backups()
+	assert.NoError(t, err)
+	assert.Len(t, backups, 11)
+	stamp := path + "." + now.Format(backupTimeFormat)
+	assert.Equal(t, stamp, backups[0])
+	assert.Equal(t, stamp+".10", backups[10])
+	// no backup was overwritten, and they are listed in rotation order
+	for i, file := range append(backups, path) {
+		data, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.Equal(t, "/"+strconv.Itoa(i), gjson.Get(string(data), "path").String())
+	}
+
+	// pruning drops the oldest of them first
+	sink.maxBackups = 3
+	assert.NoError(t, sink.prune())
+	backups, _ = sink.backups()
+	assert.Equal(t, []string{stamp + ".8", stamp + ".9", stamp + ".10"}, backups)
+}
+
+func TestFileSinkConcurrentRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	sink, err := NewFileSink(path, 1, 0)
+	assert.NoError(t, err)
+	sink.maxSize = 1000
+	var mu sync.Mutex
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	sink.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_ = sink.Write(context.Background(), LogFormatterParams{Path: "/ping"})
+			}
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, sink.Close())
+
+	backups, _ := sink.backups()
+	lines := 0
+	for _, file := range append(backups, path) {
+		data, _ := os.ReadFile(file)
+		lines += strings.Count(string(data), "\n")
+	}
+	assert.Equal(t, 400, lines)
+	assert.Greater(t, len(backups), 1)
+}
+
+func TestRecovery(t *testing.T) {
+	log, hook := newHookLogger()
+	router := gin.New()
+	router.Use(Recovery(WithLogger(log)))
+	router.POST("/panic", func(c *gin.Context) { panic("boom") })
+	router.POST("/ok", func(c *gin.Context) {
+		data, _ := c.GetRawData()
+		c.String(http.StatusOK, "%s", data)
+	})
+
+	req := httptest.NewRequest("POST", "/panic", nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"code":500,"message":"internal server error","request_id":"req-1"}`, w.Body.String())
+	assert.Equal(t, logrus.ErrorLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Message, "panic recovered: POST /panic: boom")
+
+	// bodies are left alone
+	hook.Reset()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/ok", strings.NewReader("body")))
+	assert.Equal(t, "body", w.Body.String())
+	assert.Empty(t, hook.AllEntries())
+
+	router = gin.New()
+	router.Use(Recovery(WithWriterErrorFn(func(c *gin.Context, param *LogFormatterParams) (int, interface{}) {
+		return http.StatusBadGateway, gin.H{"error": param.ErrorMessage}
+	})))
+	router.GET("/panic", func(c *gin.Context) { panic("boom") })
+	w = performRequest(router, "GET", "/panic")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.JSONEq(t, `{"error":"boom"}`, w.Body.String())
+}
+
+func TestStatusLevelMap(t *testing.T) {
+	log, hook := newHookLogger()
+	router := newTestRouter(WithLogger(log), WithStatusLevelMap(map[int]glog.Level{
+		2:   glog.InfoLevel,
+		4:   glog.WarnLevel,
+		5:   glog.ErrorLevel,
+		401: glog.DebugLevel,
+	}))
+	for _, code := range []int{http.StatusNotFound, http.StatusServiceUnavailable, http.StatusUnauthorized, http.StatusMovedPermanently} {
+		code := code
+		router.GET(fmt.Sprintf("/%d", code), func(c *gin.Context) { c.Status(code) })
+	}
+
+	want := []logrus.Level{logrus.InfoLevel, logrus.WarnLevel, logrus.ErrorLevel, logrus.DebugLevel, logrus.DebugLevel}
+	for i, path := range []string{"/ping", "/404", "/503", "/401", "/301"} {
+		hook.Reset()
+		performRequest(router, "GET", path)
+		assert.Equal(t, want[i], hook.LastEntry().Level, path)
+	}
+
+	// the default keeps every line at Debug
+	log, hook = newHookLogger()
+	router = newTestRouter(WithLogger(log))
+	performRequest(router, "GET", "/missing")
+	assert.Equal(t, logrus.DebugLevel, hook.LastEntry().Level)
+}
+
+func TestEnrich(t *testing.T) {
+	enrich := WithEnrich(func(c *gin.Context, param *LogFormatterParams) {
+		param.setField("tenant", c.GetHeader("X-Tenant"))
+		param.Path = "/masked"
+		if strings.Contains(param.RequestData, "***") {
+			param.setField("redacted", true)
+		}
+	})
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), enrich, WithRedactKeys([]string{"password"}))
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"password":"x"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tenant", "acme")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "acme", sink.entries[0].Fields["tenant"])
+	assert.Equal(t, true, sink.entries[0].Fields["redacted"])
+	assert.Equal(t, "/masked", sink.entries[0].Path)
+	assert.Equal(t, "POST /masked 404", sink.entries[0].Message)
+
+	log, _ := newHookLogger()
+	sink = &recordSink{}
+	router = gin.New()
+	router.GET("/panic", NewErrorLogger(WithLogger(log), WithSink(sink), enrich), func(c *gin.Context) { panic("boom") })
+	req = httptest.NewRequest("GET", "/panic", nil)
+	req.Header.Set("X-Tenant", "acme")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "acme", sink.entries[0].Fields["tenant"])
+	assert.Equal(t, "/masked", sink.entries[0].Path)
+}
+
+func TestCaptureHeaders(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithCaptureHeaders(true))
+	router.GET("/login", func(c *gin.Context) {
+		c.Header("X-Upstream", "api-1")
+		c.SetCookie("session", "secret", 0, "/", "", true, true)
+		c.Status(http.StatusNoContent)
+	})
+	req := httptest.NewRequest("GET", "/login", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	entry := sink.entries[0]
+	assert.Equal(t, "10.0.0.1", entry.RequestHeaders.Get("X-Forwarded-For"))
+	assert.Equal(t, "***", entry.RequestHeaders.Get("Authorization"))
+	assert.Equal(t, "Bearer secret", req.Header.Get("Authorization"))
+	assert.Equal(t, "api-1", entry.ResponseHeaders.Get("X-Upstream"))
+	assert.Equal(t, "***", entry.ResponseHeaders.Get("Set-Cookie"))
+
+	// headers follow the body capture gating
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithCaptureHeaders(true), WithDebugHeader("X-Debug-Log", "0123456789abcdef"))
+	performRequest(router, "GET", "/ping")
+	assert.Nil(t, sink.entries[0].RequestHeaders)
+	assert.Nil(t, sink.entries[0].ResponseHeaders)
+}
+
+func TestFileDownloads(t *testing.T) {
+	dir := t.TempDir()
+	large := filepath.Join(dir, "large.txt")
+	assert.NoError(t, os.WriteFile(large, bytes.Repeat([]byte("a"), 2<<20), 0o644))
+	small := filepath.Join(dir, "small.csv")
+	assert.NoError(t, os.WriteFile(small, []byte("id,name\n1,gopher\n"), 0o644))
+
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink))
+	router.GET("/files/large.txt", func(c *gin.Context) { c.File(large) })
+	router.GET("/export", func(c *gin.Context) { c.FileAttachment(small, "users.csv") })
+	router.GET("/stream", func(c *gin.Context) {
+		for i := 0; i < 3; i++ {
+			_, _ = c.Writer.WriteString(strings.Repeat("b", 1<<19))
+		}
+	})
+
+	w := performRequest(router, "GET", "/files/large.txt")
+	assert.Equal(t, 2<<20, w.Body.Len())
+	assert.Equal(t, "<file download: large.txt, 2097152 bytes>", sink.entries[0].ResponseData)
+
+	w = performRequest(router, "GET", "/export")
+	assert.Equal(t, "id,name\n1,gopher\n", w.Body.String())
+	assert.Equal(t, "<file download: users.csv, 17 bytes>", sink.entries[1].ResponseData)
+
+	w = performRequest(router, "GET", "/stream")
+	assert.Equal(t, 3<<19, w.Body.Len())
+	assert.Equal(t, "<file download: stream, 1572864 bytes>", sink.entries[2].ResponseData)
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithDownloadThreshold(0))
+	router.GET("/stream", func(c *gin.Context) {
+		_, _ = c.Writer.WriteString(strings.Repeat("b", 2<<20))
+	})
+	performRequest(router, "GET", "/stream")
+	assert.Len(t, sink.entries[0].ResponseData, 2<<20)
+}
+
+func TestOutput(t *testing.T) {
+	var buf bytes.Buffer
+	router := newTestRouter(WithOutput(&buf), WithFormatter(func(param LogFormatterParams) string {
+		return fmt.Sprintf("%s %s %d", param.Method, param.Path, param.StatusCode)
+	}))
+	performRequest(router, "GET", "/ping")
+	performRequest(router, "GET", "/missing")
+	assert.Equal(t, "GET /ping 200\nGET /missing 404\n", buf.String())
+
+	// the structured logger wins when both are set
+	log, hook := newHookLogger()
+	buf.Reset()
+	router = newTestRouter(WithOutput(&buf), WithLogger(log))
+	performRequest(router, "GET", "/ping")
+	assert.Empty(t, buf.String())
+	assert.Contains(t, hook.LastEntry().Message, "/ping")
+}
+
+func TestErrorLoggerEmit(t *testing.T) {
+	// panics are logged like access lines, through WithOutput and the formatter
+	var buf bytes.Buffer
+	router := gin.New()
+	router.GET("/panic", NewErrorLogger(WithOutput(&buf), WithFormatter(func(param LogFormatterParams) string {
+		return fmt.Sprintf("%s %s %d %s", param.Method, param.Path, param.StatusCode, param.ErrorMessage)
+	})), func(c *gin.Context) { panic("boom") })
+	performRequest(router, "GET", "/panic")
+	assert.Equal(t, "GET /panic 500 boom\n", buf.String())
+
+	// at the level of the status sent
+	log, hook := newHookLogger()
+	router = gin.New()
+	router.GET("/panic", NewErrorLogger(WithLogger(log), WithStatusLevelMap(map[int]glog.Level{5: glog.WarnLevel})), func(c *gin.Context) { panic("boom") })
+	performRequest(router, "GET", "/panic")
+	assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Message, "500")
+}
+
+func TestMetricsHook(t *testing.T) {
+	type observation struct {
+		method, path string
+		status       int
+	}
+	var got []observation
+	router := gin.New()
+	router.Use(New(WithOutput(io.Discard), WithEndpointLabelMappingFn(FullPathLabel), WithMetricsHook(func(method, path string, status int, latency time.Duration) {
+		assert.Greater(t, latency, time.Duration(0))
+		got = append(got, observation{method, path, status})
+	})))
+	router.GET("/users/:id", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	performRequest(router, "GET", "/users/42?expand=1")
+	performRequest(router, "GET", "/users/43")
+	assert.Equal(t, []observation{
+		{"GET", "/users/:id", http.StatusNoContent},
+		{"GET", "/users/:id", http.StatusNoContent},
+	}, got)
+}
+
+func TestCurlOnError(t *testing.T) {
+	log, hook := newHookLogger()
+	sink := &recordSink{}
+	router := newTestRouter(WithLogger(log), WithSink(sink), WithCurlOnError(true), WithRedactKeys([]string{"password"}))
+	router.POST("/login", func(c *gin.Context) { c.Status(http.StatusBadGateway) })
+
+	req := httptest.NewRequest("POST", "/login?next=it's", strings.NewReader(`{"password":"x","user":"gopher"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	want := `curl -X POST 'http://example.com/login?next=it'\''s' -H 'Authorization: ***' -H 'Content-Type: application/json' --data-binary '{"password":"***","user":"gopher"}'`
+	assert.Equal(t, want, sink.entries[0].Fields["curl"])
+	assert.Equal(t, "reproduce with: "+want, hook.LastEntry().Message)
+
+	performRequest(router, "GET", "/missing")
+	assert.NotContains(t, sink.entries[1].Fields, "curl")
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithCurlOnError(true), WithCurlMinStatus(http.StatusBadRequest))
+	performRequest(router, "GET", "/missing")
+	assert.Equal(t, "curl -X GET 'http://example.com/missing'", sink.entries[0].Fields["curl"])
+
+	// a body cut by WithMaxRequestBodyRead is not replayed
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithCurlOnError(true), WithMaxRequestBodyRead(4))
+	router.POST("/upload", func(c *gin.Context) { c.Status(http.StatusBadGateway) })
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("0123456789")))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/upload", strings.NewReader("abc")))
+	assert.Equal(t, "curl -X POST 'http://example.com/upload' # body omitted, larger than 4 bytes", sink.entries[0].Fields["curl"])
+	assert.Equal(t, "curl -X POST 'http://example.com/upload' --data-binary 'abc'", sink.entries[1].Fields["curl"])
+}
+
+func TestFullPathLabel(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithEndpointLabelMappingFn(FullPathLabel))
+	router.GET("/users/:id/orders/*rest", func(c *gin.Context) {})
+
+	performRequest(router, "GET", "/users/12345/orders/2024/01?page=2")
+	performRequest(router, "GET", "/unknown/12345")
+	assert.Equal(t, "/users/:id/orders/*rest?page=2", sink.entries[0].Path)
+	assert.Equal(t, "/unknown/12345", sink.entries[1].Path)
+}
+
+func TestMaxRequestBodyRead(t *testing.T) {
+	sink := &recordSink{}
+	var received string
+	router := gin.New()
+	router.Use(New(WithSink(sink), WithMaxRequestBodyRead(4)))
+	router.POST("/upload", func(c *gin.Context) {
+		if c.Request.Body != nil {
+			data, _ := io.ReadAll(c.Request.Body)
+			received = string(data)
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	body := strings.Repeat("0123456789", 100)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/upload", strings.NewReader(body)))
+	assert.Equal(t, body, received)
+	assert.Equal(t, "request body exceeds read limit, limit size: 4 \n0123", sink.entries[0].RequestData)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/upload", strings.NewReader("abc")))
+	assert.Equal(t, "abc", received)
+	assert.Equal(t, "abc", sink.entries[1].RequestData)
+
+	// a nil body must not panic
+	req := httptest.NewRequest("POST", "/upload", nil)
+	req.Body = nil
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// a cut JSON body cannot be redacted, none of it is logged
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithMaxRequestBodyRead(30), WithRedactKeys([]string{"password"}))
+	router.POST("/login", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	body = `{"password":"hunter2-secret","user":"gopher","remember":true}`
+	req = httptest.NewRequest("POST", "/login", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "request body exceeds read limit, limit size: 30", sink.entries[0].RequestData)
+	assert.NotContains(t, sink.entries[0].RequestData, "hunter2")
+}
+
+func TestRequestResponseLogContentTypes(t *testing.T) {
+	sink := &recordSink{}
+	router := gin.New()
+	router.Use(New(WithSink(sink),
+		WithCaptureContentTypes([]string{"text/"}),
+		WithRequestLogContentTypes([]string{"application/json"}),
+		WithResponseLogContentTypes([]string{"application/json"}),
+	))
+	router.POST("/upload", func(c *gin.Context) {
+		file, err := c.FormFile("file")
+		assert.NoError(t, err)
+		c.JSON(http.StatusOK, gin.H{"name": file.Filename})
+	})
+	router.POST("/echo", func(c *gin.Context) {
+		data, _ := io.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, string(data))
+	})
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "a.bin")
+	_, _ = part.Write([]byte("binary upload"))
+	_ = form.Close()
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, sink.entries[0].RequestData)
+	assert.Equal(t, `{"name":"a.bin"}`, sink.entries[0].ResponseData)
+
+	req = httptest.NewRequest("POST", "/echo", strings.NewReader(`{"a":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, `{"a":1}`, sink.entries[1].RequestData)
+	// text/plain is only in the combined list, the response list replaces it
+	assert.Empty(t, sink.entries[1].ResponseData)
+
+	// an empty side falls back to the combined list
+	sink = &recordSink{}
+	router = gin.New()
+	router.Use(New(WithSink(sink), WithCaptureContentTypes([]string{"text/"}), WithRequestLogContentTypes(nil)))
+	router.POST("/echo", func(c *gin.Context) {
+		data, _ := io.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, string(data))
+	})
+	req = httptest.NewRequest("POST", "/echo", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "text/plain")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "hello", sink.entries[0].RequestData)
+	assert.Equal(t, "hello", sink.entries[0].ResponseData)
+}
+
+func TestCoalesce(t *testing.T) {
+	sink := &recordSink{}
+	coalescer := NewCoalescer(time.Hour)
+	router := newTestRouter(WithSink(sink), WithCoalescer(coalescer))
+	router.GET("/other", func(c *gin.Context) {})
+
+	for i := 0; i < 3; i++ {
+		performRequest(router, "GET", "/ping")
+	}
+	assert.Empty(t, sink.entries)
+
+	// a different request ends the run
+	performRequest(router, "GET", "/other")
+	assert.Len(t, sink.entries, 1)
+	assert.Equal(t, 3, sink.entries[0].Count)
+	assert.Equal(t, 3, sink.entries[0].Fields["count"])
+	assert.Contains(t, sink.entries[0].Fields, "window")
+	assert.True(t, strings.HasSuffix(defaultLogFormatter(sink.entries[0]), " x3"))
+	assert.Equal(t, defaultLogFormatter(sink.entries[0]), FastTextFormatter(sink.entries[0]))
+
+	// Close writes the pending run, a single request keeps no count
+	assert.NoError(t, coalescer.Close())
+	assert.Len(t, sink.entries, 2)
+	assert.Equal(t, "/other", sink.entries[1].Path)
+	assert.Zero(t, sink.entries[1].Count)
+	assert.Nil(t, sink.entries[1].Fields)
+
+	performRequest(router, "GET", "/ping")
+	assert.Len(t, sink.entries, 3)
+}
+
+func TestCoalesceShared(t *testing.T) {
+	public, admin := &recordSink{}, &recordSink{}
+	coalescer := NewCoalescer(time.Hour)
+	router := gin.New()
+	router.GET("/ping", New(WithSink(public), WithCoalescer(coalescer)), func(c *gin.Context) {})
+	router.GET("/admin/ping", New(WithSink(admin), WithCoalescer(coalescer), WithEndpointLabelMappingFn(func(c *gin.Context) string {
+		return "/ping"
+	})), func(c *gin.Context) {})
+
+	// same key, but each middleware keeps its own run and sink
+	performRequest(router, "GET", "/ping")
+	performRequest(router, "GET", "/ping")
+	performRequest(router, "GET", "/admin/ping")
+	assert.NoError(t, coalescer.Close())
+	assert.Len(t, public.entries, 1)
+	assert.Equal(t, 2, public.entries[0].Count)
+	assert.Len(t, admin.entries, 1)
+	assert.Zero(t, admin.entries[0].Count)
+}
+
+func TestCoalesceWindow(t *testing.T) {
+	sink := &recordSink{}
+	coalescer := NewCoalescer(20 * time.Millisecond)
+	router := newTestRouter(WithSink(sink), WithCoalescer(coalescer))
+	performRequest(router, "GET", "/ping")
+	performRequest(router, "GET", "/ping")
+	assert.Eventually(t, func() bool {
+		coalescer.mu.Lock()
+		defer coalescer.mu.Unlock()
+		return coalescer.pending == nil
+	}, time.Second, 5*time.Millisecond)
+	assert.Len(t, sink.entries, 1)
+	assert.Equal(t, 2, sink.entries[0].Count)
+}
+
+func TestCoalesceConcurrent(t *testing.T) {
+	sink := &recordSink{}
+	coalescer := NewCoalescer(time.Hour)
+	router := newTestRouter(WithSink(sink), WithCoalescer(coalescer))
+	router.GET("/other", func(c *gin.Context) {})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if (i+j)%5 == 0 {
+					performRequest(router, "GET", "/other")
+				} else {
+					performRequest(router, "GET", "/ping")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.NoError(t, coalescer.Close())
+	total := 0
+	for _, entry := range sink.entries {
+		total += max(entry.Count, 1)
+	}
+	assert.Equal(t, 400, total)
+}
+
+func TestMiddlewareLatency(t *testing.T) {
+	sink := &recordSink{}
+	router := gin.New()
+	router.Use(New(WithSink(sink), WithMiddlewareLatency(true)))
+	router.Use(func(c *gin.Context) {
+		if c.Query("deny") != "" {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}, MarkHandlerStart())
+	router.GET("/ping", func(c *gin.Context) {
+		time.Sleep(10 * time.Millisecond)
+		c.String(http.StatusOK, "pong")
+	})
+
+	performRequest(router, "GET", "/ping")
+	entry := sink.entries[0]
+	assert.GreaterOrEqual(t, entry.MiddlewareLatency, 20*time.Millisecond)
+	assert.GreaterOrEqual(t, entry.HandlerLatency, 10*time.Millisecond)
+	assert.Less(t, entry.HandlerLatency, entry.MiddlewareLatency)
+	assert.Equal(t, entry.Latency, entry.MiddlewareLatency+entry.HandlerLatency)
+	assert.Equal(t, entry.MiddlewareLatency, entry.Fields["middleware_latency"])
+	assert.Equal(t, entry.HandlerLatency, entry.Fields["handler_latency"])
+
+	// the handler was never reached
+	performRequest(router, "GET", "/ping?deny=1")
+	assert.Zero(t, sink.entries[1].HandlerLatency)
+	assert.NotContains(t, sink.entries[1].Fields, "middleware_latency")
+
+	// off by default
+	sink = &recordSink{}
+	router = gin.New()
+	router.Use(New(WithSink(sink)), MarkHandlerStart())
+	router.GET("/ping", func(c *gin.Context) {})
+	performRequest(router, "GET", "/ping")
+	assert.Zero(t, sink.entries[0].MiddlewareLatency)
+	assert.Nil(t, sink.entries[0].Fields)
+}
+
+func TestRedactQueryKeys(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithRedactQueryKeys([]string{"Token", " secret "}))
+
+	for query, want := range map[string]string{
+		// several keys, a repeated key, other parameters left as they are
+		"token=a&id=1&secret=b&token=c": "token=***&id=1&secret=***&token=***",
+		// keys match whatever their case, values are kept encoded as sent
+		"TOKEN=a&Secret=b&Name=X%20Y": "TOKEN=***&Secret=***&Name=X%20Y",
+		// URL-encoded values and keys
+		"secret=a%2Fb%3Dc&sec%72et=d": "secret=***&sec%72et=***",
+		// a key without value has nothing to mask
+		"token&id=1": "token&id=1",
+		// default keys are replaced
+		"api_key=k": "api_key=k",
+	} {
+		sink.entries = nil
+		performRequest(router, "GET", "/ping?"+query)
+		assert.Equal(t, "/ping?"+want, sink.entries[0].Path, query)
+	}
+
+	// an empty query adds nothing to the path
+	sink.entries = nil
+	performRequest(router, "GET", "/ping?")
+	assert.Equal(t, "/ping", sink.entries[0].Path)
+
+	// an empty list disables masking
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithRedactQueryKeys(nil))
+	performRequest(router, "GET", "/ping?token=a")
+	assert.Equal(t, "/ping?token=a", sink.entries[0].Path)
+}
+
+// lockedSink is a recordSink safe for concurrent requests.
+type lockedSink struct {
+	mu      sync.Mutex
+	entries []LogFormatterParams
+}
+
+func (s *lockedSink) Write(_ context.Context, params LogFormatterParams) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, params)
+	return nil
+}
+
+func TestErrorLogRateLimit(t *testing.T) {
+	sink := &lockedSink{}
+	log, hook := newHookLogger()
+	router := gin.New()
+	// every request falls in the same window, however slow the run
+	now := time.Now()
+	fixedClock := func(cfg *config) { cfg.errorLimiter.now = func() time.Time { return now } }
+	router.Use(New(WithLogger(log), WithSink(sink), WithErrorLogRateLimit(2), fixedClock))
+	router.GET("/fail", func(c *gin.Context) { c.Status(http.StatusInternalServerError) })
+	router.GET("/ok", func(c *gin.Context) {})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				performRequest(router, "GET", "/fail")
+				performRequest(router, "GET", "/ok")
+			}
+		}()
+	}
+	wg.Wait()
+	// once the limit is hit 5xx entries are dropped, other statuses are never limited
+	var failed int
+	for _, entry := range sink.entries {
+		if entry.StatusCode == http.StatusInternalServerError {
+			failed++
+		}
+	}
+	assert.Equal(t, 2, failed)
+	assert.Len(t, sink.entries, 82)
+	assert.Contains(t, hook.LastEntry().Message, "/ok")
+
+	// the limit refills with the next window, reporting what was suppressed
+	limiter := newErrorLimiter(2)
+	for i := 0; i < 2; i++ {
+		ok, _ := limiter.allow("GET /fail 500", now)
+		assert.True(t, ok)
+	}
+	ok, _ := limiter.allow("GET /fail 500", now.Add(500*time.Millisecond))
+	assert.False(t, ok)
+	ok, suppressed := limiter.allow("GET /fail 500", now.Add(time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, 1, suppressed)
+
+	// per-key state stays bounded: expired windows are evicted to make room
+	limiter = newErrorLimiter(1)
+	for i := 0; i < maxRateLimitKeys; i++ {
+		limiter.allow(strconv.Itoa(i), now)
+	}
+	assert.Len(t, limiter.windows, maxRateLimitKeys)
+	ok, _ = limiter.allow("new", now)
+	assert.True(t, ok)
+	assert.Len(t, limiter.windows, maxRateLimitKeys)
+	ok, _ = limiter.allow("newer", now.Add(time.Second))
+	assert.True(t, ok)
+	assert.Len(t, limiter.windows, 1)
+}
+
+func TestDuplicateDetection(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithDuplicateDetection(time.Hour))
+	retry := func(key string) LogFormatterParams {
+		req := httptest.NewRequest("GET", "/ping", nil)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		return sink.entries[len(sink.entries)-1]
+	}
+
+	first := retry("k1")
+	assert.Equal(t, "k1", first.IdempotencyKey)
+	assert.False(t, first.Duplicate)
+	// a retry within the window is still logged, flagged as a duplicate
+	assert.True(t, retry("k1").Duplicate)
+	assert.False(t, retry("k2").Duplicate)
+	assert.False(t, retry("").Duplicate)
+	assert.Len(t, sink.entries, 4)
+
+	// after the window the key is fresh again
+	seen := newSeenSet(time.Minute)
+	now := time.Now()
+	assert.False(t, seen.seen("k1", now))
+	assert.True(t, seen.seen("k1", now.Add(59*time.Second)))
+	assert.False(t, seen.seen("k1", now.Add(time.Minute)))
+	assert.True(t, seen.seen("k1", now.Add(time.Minute+time.Second)))
+}
+
+func TestFullURL(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithFullURL(true))
+
+	req := httptest.NewRequest("GET", "http://api.example.com/ping?id=1&token=secret", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "http://api.example.com/ping?id=1&token=***", sink.entries[0].RequestURL)
+
+	req = httptest.NewRequest("GET", "http://api.example.com/ping", nil)
+	req.Header.Set("X-Forwarded-Proto", "HTTPS, http")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "https://api.example.com/ping", sink.entries[1].RequestURL)
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink))
+	performRequest(router, "GET", "/ping")
+	assert.Empty(t, sink.entries[0].RequestURL)
+}
+
+func TestAppStatusHeader(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithAppStatusHeader("grpc-status"))
+	router.GET("/header", func(c *gin.Context) {
+		c.Header("Grpc-Status", "5")
+		c.Status(http.StatusOK)
+	})
+	router.GET("/trailer", func(c *gin.Context) {
+		c.Header(http.TrailerPrefix+"Grpc-Status", "13")
+		c.Status(http.StatusOK)
+	})
+
+	performRequest(router, "GET", "/header")
+	assert.Equal(t, "5", sink.entries[0].AppStatus)
+	performRequest(router, "GET", "/trailer")
+	assert.Equal(t, "13", sink.entries[1].AppStatus)
+	performRequest(router, "GET", "/ping")
+	assert.Empty(t, sink.entries[2].AppStatus)
+}
+
+func namedPingHandler(c *gin.Context) {
+	c.String(http.StatusOK, "pong")
+}
+
+func TestCallerInfo(t *testing.T) {
+	sink := &recordSink{}
+	router := gin.New()
+	router.Use(New(WithSink(sink), WithCallerInfo(true)))
+	router.GET("/named", namedPingHandler)
+
+	performRequest(router, "GET", "/named")
+	entry := sink.entries[0]
+	assert.True(t, strings.HasSuffix(entry.HandlerName, ".namedPingHandler"), entry.HandlerName)
+	assert.Contains(t, entry.HandlerLocation, "logger_test.go:")
+	assert.Len(t, entry.HandlerNames, 2)
+	assert.Equal(t, entry.HandlerName, entry.HandlerNames[1])
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink))
+	performRequest(router, "GET", "/ping")
+	assert.Empty(t, sink.entries[0].HandlerName)
+	assert.Empty(t, sink.entries[0].HandlerLocation)
+}
+
+func TestMessageFn(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink))
+	performRequest(router, "GET", "/ping?id=1")
+	assert.Equal(t, "GET /ping?id=1 200", sink.entries[0].Message)
+
+	sink = &recordSink{}
+	router = newTestRouter(WithSink(sink), WithFormatterName("ecs"), WithMessageFn(func(log *LogFormatterParams) string {
+		return fmt.Sprintf("%s answered %d in %s", log.Path, log.StatusCode, log.Method)
+	}))
+	performRequest(router, "GET", "/ping")
+	assert.Equal(t, "/ping answered 200 in GET", sink.entries[0].Message)
+	assert.Equal(t, "/ping answered 200 in GET", gjson.Get(ECSFormatter(sink.entries[0]), "message").String())
+	// the rest of the entry is left alone
+	assert.Equal(t, "/ping", sink.entries[0].Path)
+}
+
+type testBaggage map[string]string
+
+type testBaggageKey struct{}
+
+func TestBaggageKeys(t *testing.T) {
+	reader := func(ctx context.Context, key string) (string, bool) {
+		members, _ := ctx.Value(testBaggageKey{}).(testBaggage)
+		value, ok := members[key]
+		return value, ok
+	}
+	serve := func(router *gin.Engine) {
+		req := httptest.NewRequest("GET", "/ping", nil)
+		req = req.WithContext(context.WithValue(req.Context(), testBaggageKey{}, testBaggage{"tenant": "acme", "user": "42"}))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// only the configured members present in the baggage are added
+	sink := &recordSink{}
+	serve(newTestRouter(WithSink(sink), WithBaggageKeys([]string{"tenant", "region"}), WithBaggageReader(reader)))
+	assert.Equal(t, map[string]interface{}{"tenant": "acme"}, sink.entries[0].Fields)
+
+	// the keys are ignored without a reader
+	sink = &recordSink{}
+	serve(newTestRouter(WithSink(sink), WithBaggageKeys([]string{"tenant"})))
+	assert.Nil(t, sink.entries[0].Fields)
+
+	// and nothing is read without keys
+	sink = &recordSink{}
+	serve(newTestRouter(WithSink(sink), WithBaggageReader(reader)))
+	assert.Nil(t, sink.entries[0].Fields)
+}
+
+func TestBodyOnSlow(t *testing.T) {
+	sink := &recordSink{}
+	router := newTestRouter(WithSink(sink), WithBodyOnSlow(50*time.Millisecond))
+	router.POST("/slow", func(c *gin.Context) {
+		data, _ := c.GetRawData()
+		time.Sleep(60 * time.Millisecond)
+		c.String(http.StatusOK, "%s", data)
+	})
+
+	performRequest(router, "GET", "/ping")
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/slow", strings.NewReader("payload")))
+
+	assert.Len(t, sink.entries, 2)
+	// fast requests are logged without their bodies
+	assert.Empty(t, sink.entries[0].ResponseData)
+	// slow ones keep both
+	assert.Equal(t, "payload", sink.entries[1].RequestData)
+	assert.Equal(t, "payload", sink.entries[1].ResponseData)
+
+	// a zero threshold logs every body
+	sink = &recordSink{}
+	performRequest(newTestRouter(WithSink(sink), WithBodyOnSlow(0)), "GET", "/ping")
+	assert.Equal(t, "pong", sink.entries[0].ResponseData)
+}
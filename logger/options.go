@@ -1,8 +1,14 @@
 package logger
 
 import (
+	"context"
 	"github.com/donetkit/contrib-log/glog"
 	"github.com/gin-gonic/gin"
+	"io"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Config defines the config for logger middleware
@@ -10,21 +16,102 @@ type config struct {
 	// Optional. Default value is gin.defaultLogFormatter
 	formatter              LogFormatter
 	logger                 glog.ILoggerEntry
-	excludeRegexStatus     []string
-	excludeRegexEndpoint   []string
-	excludeRegexMethod     []string
+	excludeRegexStatus     []*regexp.Regexp
+	excludeRegexEndpoint   []*regexp.Regexp
+	excludeRegexMethod     []*regexp.Regexp
 	endpointLabelMappingFn RequestLabelMappingFn
 	writerLogFn            WriterLogFn
 	writerErrorFn          WriterErrorFn
 	bodyLength             int
 	rawDataLength          int
+	redactQueryKeys        map[string]struct{}
+	fullURL                bool
+	appStatusHeader        string
+	callerInfo             bool
+	errorLimiter           *errorLimiter
+	duplicates             *seenSet
+	debugHeader            string
+	debugSecret            string
+	messageFn              MessageFn
+	baggageKeys            []string
+	baggageReader          BaggageReader
+	bodyOnSlow             time.Duration
+	sink                   LogSink
+	counterKeys            []string
+	sinkBreaker            *sinkBreaker
+	stats                  *Stats
+	inFlight               *inFlightLimit
+	sequenceNumbers        bool
+	sequence               atomic.Uint64
+	bodySink               BodySink
+	clientSampling         func(ip string) bool
+	handlerStartKey        string
+	middlewareLatency      bool
+	loggedErrorTypes       gin.ErrorType
+	contextValueKeys       []interface{}
+	skipPaths              []string
+	prefix                 string
+	slowThreshold          time.Duration
+	verySlowThreshold      time.Duration
+	redactKeys             map[string]struct{}
+	traceURLTemplate       string
+	captureContentTypes    []string
+	requestContentTypes    []string
+	responseContentTypes   []string
+	requestIDGenerator     func() string
+	requestIDHeader        string
+	skipPreflight          bool
+	traceExtraction        bool
+	decodeResponseBody     bool
+	responseHash           bool
+	exposePanicMessage     bool
+	statusLevels           map[int]glog.Level
+	enrich                 EnrichFn
+	captureHeaders         bool
+	downloadThreshold      int64
+	output                 io.Writer
+	outputMu               sync.Mutex
+	maxRequestBodyRead     int64
+	coalescer              *Coalescer
+	metricsHook            MetricsHook
+	curlOnError            bool
+	curlMinStatus          int
 }
 
+// minDebugSecretLength is the shortest secret accepted by WithDebugHeader.
+const minDebugSecretLength = 16
+
 // Option for queue system
 type Option func(*config)
 
 type WriterLogFn func(c *gin.Context, log *LogFormatterParams)
 
+// MessageFn builds the human-readable summary stored in LogFormatterParams.Message
+type MessageFn func(log *LogFormatterParams) string
+
+// BaggageReader adapts a baggage implementation such as OpenTelemetry's, it returns the
+// value of the baggage member key carried by ctx
+type BaggageReader func(ctx context.Context, key string) (string, bool)
+
+// LogSink receives every access entry as structured params, e.g. to publish it on Kafka or
+// NATS. Write is called synchronously on the request path, so implementations should
+// buffer, batch and retry on their own and return quickly
+type LogSink interface {
+	Write(ctx context.Context, params LogFormatterParams) error
+}
+
+// MetricsHook observes every logged request, e.g. to feed a Prometheus latency histogram.
+// path is the endpointLabelMappingFn label, without the query
+type MetricsHook func(method, path string, status int, latency time.Duration)
+
+// EnrichFn adds or overrides fields of an entry, see WithEnrich
+type EnrichFn func(c *gin.Context, param *LogFormatterParams)
+
+// BodySink receives the captured request and response bodies of an entry, e.g. to store them
+// in an access-controlled bucket, keyed by the X-Request-Id also logged on the access line.
+// The slices are copies owned by the sink
+type BodySink func(requestID string, req, resp []byte)
+
 type WriterErrorFn func(c *gin.Context, log *LogFormatterParams) (int, interface{})
 
 // WithLogger set logger function
@@ -34,27 +121,47 @@ func WithLogger(logger glog.ILogger) Option {
 	}
 }
 
-// WithExcludeRegexMethod set excludeRegexMethod function regexp
+// WithExcludeRegexMethod set excludeRegexMethod function regexp, invalid patterns panic
 func WithExcludeRegexMethod(excludeRegexMethod []string) Option {
+	patterns := compilePatterns(excludeRegexMethod)
 	return func(cfg *config) {
-		cfg.excludeRegexMethod = excludeRegexMethod
+		cfg.excludeRegexMethod = patterns
 	}
 }
 
-// WithExcludeRegexStatus set excludeRegexStatus function regexp
+// WithExcludeRegexStatus set excludeRegexStatus function regexp, invalid patterns panic
 func WithExcludeRegexStatus(excludeRegexStatus []string) Option {
+	patterns := compilePatterns(excludeRegexStatus)
 	return func(cfg *config) {
-		cfg.excludeRegexStatus = excludeRegexStatus
+		cfg.excludeRegexStatus = patterns
 	}
 }
 
-// WithExcludeRegexEndpoint set excludeRegexEndpoint function regexp
+// WithExcludeRegexEndpoint set excludeRegexEndpoint function regexp, invalid patterns panic
 func WithExcludeRegexEndpoint(excludeRegexEndpoint []string) Option {
+	patterns := compilePatterns(excludeRegexEndpoint)
 	return func(cfg *config) {
-		cfg.excludeRegexEndpoint = excludeRegexEndpoint
+		cfg.excludeRegexEndpoint = patterns
 	}
 }
 
+// compilePatterns compiles the exclude patterns once. An empty pattern has always ended the
+// list, the patterns after it are dropped.
+func compilePatterns(patterns []string) []*regexp.Regexp {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		if pattern == "" {
+			break
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			panic("logger: invalid exclude pattern: " + err.Error())
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled
+}
+
 // WithEndpointLabelMappingFn set endpointLabelMappingFn function
 func WithEndpointLabelMappingFn(endpointLabelMappingFn RequestLabelMappingFn) Option {
 	return func(cfg *config) {
@@ -69,6 +176,16 @@ func WithFormatter(formatter LogFormatter) Option {
 	}
 }
 
+// WithFormatterName set the formatter registered under name with RegisterFormatter,
+// it panics on unknown names. Use LookupFormatter to validate names from configuration first
+func WithFormatterName(name string) Option {
+	f, err := LookupFormatter(name)
+	if err != nil {
+		panic(err.Error())
+	}
+	return WithFormatter(f)
+}
+
 // WithWriterLogFn set fn WriterLogFn
 func WithWriterLogFn(fn WriterLogFn) Option {
 	return func(cfg *config) {
@@ -83,16 +200,498 @@ func WithWriterErrorFn(fn WriterErrorFn) Option {
 	}
 }
 
-// WithBodyLength set fn bodyLength
+// WithBodyLength set the number of request body bytes logged, longer bodies are truncated.
+// Default unlimited, 0 captures nothing. WithRequestBodyLimit is the same option
 func WithBodyLength(bodyLength int) Option {
 	return func(cfg *config) {
 		cfg.bodyLength = bodyLength
 	}
 }
 
-// WithRawDataLength set fn rawDataLength
+// WithRawDataLength set the number of response body bytes logged, longer bodies are truncated.
+// Default unlimited, 0 captures nothing. WithResponseBodyLimit is the same option
 func WithRawDataLength(rawDataLength int) Option {
 	return func(cfg *config) {
 		cfg.rawDataLength = rawDataLength
 	}
 }
+
+// WithRequestBodyLimit is WithBodyLength under a clearer name
+func WithRequestBodyLimit(limit int) Option {
+	return WithBodyLength(limit)
+}
+
+// WithResponseBodyLimit is WithRawDataLength under a clearer name
+func WithResponseBodyLimit(limit int) Option {
+	return WithRawDataLength(limit)
+}
+
+// WithRedactQueryKeys set the query parameters whose values are masked in the logged Path,
+// default "token", "access_token", "api_key". An empty list disables masking.
+func WithRedactQueryKeys(keys []string) Option {
+	return func(cfg *config) {
+		cfg.redactQueryKeys = newKeySet(keys)
+	}
+}
+
+// WithFullURL set whether the scheme, host and path are logged as RequestURL
+func WithFullURL(fullURL bool) Option {
+	return func(cfg *config) {
+		cfg.fullURL = fullURL
+	}
+}
+
+// WithAppStatusHeader set the response header or trailer carrying the application status,
+// e.g. "grpc-status" for grpc-web, logged as AppStatus
+func WithAppStatusHeader(name string) Option {
+	return func(cfg *config) {
+		cfg.appStatusHeader = name
+	}
+}
+
+// WithCallerInfo set whether the handler name, its source location and the handler chain are logged
+func WithCallerInfo(callerInfo bool) Option {
+	return func(cfg *config) {
+		cfg.callerInfo = callerInfo
+	}
+}
+
+// WithErrorLogRateLimit set the maximum number of 5xx and panic log entries per second
+// for each route and status, the rest is suppressed and summarized
+func WithErrorLogRateLimit(perSecond int) Option {
+	return func(cfg *config) {
+		if perSecond > 0 {
+			cfg.errorLimiter = newErrorLimiter(perSecond)
+		}
+	}
+}
+
+// WithDuplicateDetection set the window within which a repeated Idempotency-Key marks the request as Duplicate
+func WithDuplicateDetection(window time.Duration) Option {
+	return func(cfg *config) {
+		if window > 0 {
+			cfg.duplicates = newSeenSet(window)
+		}
+	}
+}
+
+// WithDebugHeader set a header that enables request and response body capture only for the
+// requests carrying secret, e.g. WithDebugHeader("X-Debug-Log", secret). The secret must be
+// at least 16 characters long, it is compared in constant time
+func WithDebugHeader(name, secret string) Option {
+	if name == "" || len(secret) < minDebugSecretLength {
+		panic("logger: WithDebugHeader needs a header name and a secret of at least 16 characters")
+	}
+	return func(cfg *config) {
+		cfg.debugHeader = name
+		cfg.debugSecret = secret
+	}
+}
+
+// WithMessageFn set fn building the summary Message while keeping the rest of the formatter output
+func WithMessageFn(fn MessageFn) Option {
+	return func(cfg *config) {
+		cfg.messageFn = fn
+	}
+}
+
+// WithBaggageKeys set the baggage members added to Fields, read through WithBaggageReader
+func WithBaggageKeys(keys []string) Option {
+	return func(cfg *config) {
+		cfg.baggageKeys = keys
+	}
+}
+
+// WithBaggageReader set the adapter used by WithBaggageKeys, for OpenTelemetry:
+//
+//	logger.WithBaggageReader(func(ctx context.Context, key string) (string, bool) {
+//		member := baggage.FromContext(ctx).Member(key)
+//		return member.Value(), member.Key() != ""
+//	})
+func WithBaggageReader(reader BaggageReader) Option {
+	return func(cfg *config) {
+		cfg.baggageReader = reader
+	}
+}
+
+// WithBodyOnSlow set the latency from which request and response bodies are logged. Bodies are
+// still buffered for every captured request since the latency is only known at the end, so this
+// trims log volume, not memory
+func WithBodyOnSlow(threshold time.Duration) Option {
+	return func(cfg *config) {
+		cfg.bodyOnSlow = threshold
+	}
+}
+
+// WithSink set a LogSink receiving entries next to, or instead of, the logger
+func WithSink(sink LogSink) Option {
+	return func(cfg *config) {
+		cfg.sink = sink
+	}
+}
+
+// WithCounterKeys set numeric c.Keys entries, e.g. "db.queries" or "cache.hits", added to Fields.
+// Integers are logged as int64, floats as float64, *atomic.Int64 and *atomic.Uint64 are loaded,
+// other values are skipped
+func WithCounterKeys(keys []string) Option {
+	return func(cfg *config) {
+		cfg.counterKeys = keys
+	}
+}
+
+// WithFileSink set a FileSink writing NDJSON entries to path, rotated past maxSizeMB megabytes
+// and daily, keeping maxBackups rotated files. It panics when the file cannot be opened; use
+// NewFileSink with WithSink to handle the error and to Flush or Close the file on shutdown
+func WithFileSink(path string, maxSizeMB, maxBackups int) Option {
+	sink, err := NewFileSink(path, maxSizeMB, maxBackups)
+	if err != nil {
+		panic("logger: file sink: " + err.Error())
+	}
+	return WithSink(sink)
+}
+
+// WithSinkBreaker set a circuit breaker on the LogSink: after threshold consecutive Write errors
+// entries are dropped for cooldown, then one probe entry decides whether to resume or wait
+// another cooldown. Sinks should return an error on timeout for it to count as a failure
+func WithSinkBreaker(threshold int, cooldown time.Duration) Option {
+	return func(cfg *config) {
+		if threshold <= 0 {
+			cfg.sinkBreaker = nil
+			return
+		}
+		cfg.sinkBreaker = newSinkBreaker(threshold, cooldown)
+	}
+}
+
+// WithInFlightLimit set the in-flight request count at which a warning is logged, and the hard cap
+// above which requests are rejected with 503 before reaching the handlers. 0 disables either one,
+// the current count is exposed by Stats.InFlight. Register the middleware first for the cap to shed
+// load before any other work is done
+func WithInFlightLimit(warnAt, hardCap int) Option {
+	return func(cfg *config) {
+		if warnAt <= 0 && hardCap <= 0 {
+			cfg.inFlight = nil
+			return
+		}
+		cfg.inFlight = &inFlightLimit{warnAt: int64(warnAt), hardCap: int64(hardCap)}
+	}
+}
+
+// WithStats set the Stats receiving the counters of the middleware, e.g. for a metrics endpoint
+func WithStats(stats *Stats) Option {
+	return func(cfg *config) {
+		cfg.stats = stats
+	}
+}
+
+// WithSequenceNumbers set whether entries carry a monotonically increasing Sequence, to recover
+// the emission order when timestamps collide. Only structured formatters such as ECSFormatter
+// and LogSink implementations see it
+func WithSequenceNumbers(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.sequenceNumbers = enabled
+	}
+}
+
+// WithBodySink set a BodySink receiving the captured bodies instead of the logger and the LogSink,
+// RequestData and ResponseData are then left empty. Bodies are passed whole, WithBodyLength and
+// WithRawDataLength only limit inlined bodies. The capture rules (WithDebugHeader, WithBodyOnSlow)
+// still apply; a panicking request has no response body
+func WithBodySink(sink BodySink) Option {
+	return func(cfg *config) {
+		cfg.bodySink = sink
+	}
+}
+
+// WithClientSampling set a function selecting the client IPs whose bodies are captured, e.g. to
+// follow a single misbehaving client. Other clients get the access line only. Combined with
+// WithDebugHeader, a request is captured when either of them selects it
+func WithClientSampling(fn func(ip string) bool) Option {
+	return func(cfg *config) {
+		cfg.clientSampling = fn
+	}
+}
+
+// WithMiddlewareLatency set whether the time spent in the middlewares before the handler and in
+// the handler itself are logged, as MiddlewareLatency and HandlerLatency and the
+// "middleware_latency" and "handler_latency" fields. The logger must be registered first and
+// MarkHandlerStart last, right before the handlers; everything between them counts as
+// middleware. Entries of requests that never reached MarkHandlerStart get neither. Default false
+func WithMiddlewareLatency(enabled bool) Option {
+	return func(cfg *config) {
+		cfg.middlewareLatency = enabled
+	}
+}
+
+// WithHandlerStartKey set the c.Keys (or request context) key holding the time.Time at which the
+// upstream middleware, e.g. auth or rate limiting, handed over to the handler. Entries carrying it
+// get HandlerLatency and the "total_latency" and "handler_latency" fields, the others the total only
+func WithHandlerStartKey(key string) Option {
+	return func(cfg *config) {
+		cfg.handlerStartKey = key
+	}
+}
+
+// WithLoggedErrorTypes set the c.Errors types logged in ErrorMessage, default gin.ErrorTypePrivate.
+// Types are bit flags, e.g. gin.ErrorTypePrivate|gin.ErrorTypeBind also logs binding errors
+func WithLoggedErrorTypes(types gin.ErrorType) Option {
+	return func(cfg *config) {
+		cfg.loggedErrorTypes = types
+	}
+}
+
+// WithContextValueKeys set keys read from c.Request.Context(), for libraries storing values with
+// context.WithValue rather than c.Set, which WithCounterKeys reads. Found values are added to
+// Fields under fmt.Sprint(key), so typed keys should implement fmt.Stringer. Nil values are skipped
+func WithContextValueKeys(keys []interface{}) Option {
+	return func(cfg *config) {
+		cfg.contextValueKeys = keys
+	}
+}
+
+// WithSkipPaths set path prefixes, e.g. "/healthz", "/metrics" or "/static", never logged. A prefix
+// matches whole path segments: "/static" skips "/static" and "/static/app.js", not "/statistics".
+// Unlike WithExcludeRegexEndpoint the check runs first, without regexp nor body buffering
+func WithSkipPaths(paths []string) Option {
+	return func(cfg *config) {
+		cfg.skipPaths = paths
+	}
+}
+
+// WithPrefix set a tag such as "[access]" put in front of text lines, or rendered as the logger
+// field by JSONFormatter and ECSFormatter, to recognize access lines in a shared stream
+func WithPrefix(prefix string) Option {
+	return func(cfg *config) {
+		cfg.prefix = prefix
+	}
+}
+
+// WithSlowThreshold set the latency from which access lines are logged at Warn instead of Debug
+func WithSlowThreshold(threshold time.Duration) Option {
+	return func(cfg *config) {
+		cfg.slowThreshold = threshold
+	}
+}
+
+// WithVerySlowThreshold set the latency from which access lines are logged at Error, it should be
+// above the WithSlowThreshold one
+func WithVerySlowThreshold(threshold time.Duration) Option {
+	return func(cfg *config) {
+		cfg.verySlowThreshold = threshold
+	}
+}
+
+// WithRedactKeys set JSON keys, e.g. "password", "authorization" or "token", whose values are
+// replaced with "***" in captured JSON bodies, whatever their case and depth. Redaction happens
+// before WithBodyLength and WithRawDataLength truncation; non-JSON bodies are kept as is
+func WithRedactKeys(keys []string) Option {
+	return func(cfg *config) {
+		cfg.redactKeys = newKeySet(keys)
+	}
+}
+
+// WithTraceURLTemplate set a trace viewer URL such as "https://jaeger.example.com/trace/{traceID}",
+// entries with a TraceId get it with {traceID} substituted in the "trace_url" field
+func WithTraceURLTemplate(template string) Option {
+	return func(cfg *config) {
+		cfg.traceURLTemplate = template
+	}
+}
+
+// WithCaptureContentTypes set the request and response Content-Types whose body is captured,
+// other responses only get BodySize and other request bodies are not read. "text/" matches a
+// top-level type, "+json" a suffix, other entries the exact media type. The default covers text,
+// JSON, XML, JavaScript and form bodies, nil captures all. Request bodies without a Content-Type
+// are always captured
+func WithCaptureContentTypes(types []string) Option {
+	return func(cfg *config) {
+		cfg.captureContentTypes = types
+	}
+}
+
+// WithRequestLogContentTypes set the request Content-Types whose body is captured, in place of
+// the WithCaptureContentTypes list. Empty falls back to that list
+func WithRequestLogContentTypes(types []string) Option {
+	return func(cfg *config) {
+		cfg.requestContentTypes = types
+	}
+}
+
+// WithResponseLogContentTypes set the response Content-Types whose body is captured, in place of
+// the WithCaptureContentTypes list. Empty falls back to that list
+func WithResponseLogContentTypes(types []string) Option {
+	return func(cfg *config) {
+		cfg.responseContentTypes = types
+	}
+}
+
+// WithRequestIDGenerator set the function generating a request id when the request carries none,
+// default a UUIDv4. The id is set on the response header and in the gin context under RequestIDKey
+// before the handlers run, nil disables generation
+func WithRequestIDGenerator(fn func() string) Option {
+	return func(cfg *config) {
+		cfg.requestIDGenerator = fn
+	}
+}
+
+// WithRequestIDHeader set the request id header name, default "X-Request-Id"
+func WithRequestIDHeader(name string) Option {
+	return func(cfg *config) {
+		cfg.requestIDHeader = name
+	}
+}
+
+// WithSkipPreflight set whether successful CORS preflights, OPTIONS requests carrying
+// Access-Control-Request-Method and answered with 2xx, are left out of the access log.
+// Failing preflights are still logged
+func WithSkipPreflight(skip bool) Option {
+	return func(cfg *config) {
+		cfg.skipPreflight = skip
+	}
+}
+
+// WithTraceExtraction set whether TraceId and SpanId are filled from the OpenTelemetry span of
+// the request context, e.g. started by otelgin. Requests without a valid span keep them empty
+func WithTraceExtraction(extract bool) Option {
+	return func(cfg *config) {
+		cfg.traceExtraction = extract
+	}
+}
+
+// WithDecodeResponseBody set whether gzip and deflate response bodies are decompressed before being
+// logged. No more than WithRawDataLength bytes are inflated; when WithRedactKeys is set a body cut
+// by that limit is not logged at all, since a partial JSON document cannot be redacted
+func WithDecodeResponseBody(decode bool) Option {
+	return func(cfg *config) {
+		cfg.decodeResponseBody = decode
+	}
+}
+
+// WithResponseETagHash set whether a hash of the captured response body is logged in the
+// "response_hash" field, to spot identical responses or unexpected variation. Only captured
+// bodies no longer than WithRawDataLength are hashed. The hash is not sent as an ETag: the
+// body is streamed to the client before it is known
+func WithResponseETagHash(hash bool) Option {
+	return func(cfg *config) {
+		cfg.responseHash = hash
+	}
+}
+
+// WithExposePanicMessage set whether the PanicResponse of ErrorLoggerT carries the panic message
+// instead of "internal server error". Panic messages may leak internals, keep it for development
+func WithExposePanicMessage(expose bool) Option {
+	return func(cfg *config) {
+		cfg.exposePanicMessage = expose
+	}
+}
+
+// StatusClassLevels logs 2xx and 3xx at Info, 4xx at Warn and 5xx at Error, for WithStatusLevelMap
+var StatusClassLevels = map[int]glog.Level{
+	2: glog.InfoLevel,
+	3: glog.InfoLevel,
+	4: glog.WarnLevel,
+	5: glog.ErrorLevel,
+}
+
+// WithStatusLevelMap set the level of access lines by status. A key is an exact status such as
+// 404, or a class from 1 to 5 standing for 1xx to 5xx; exact codes win. Unmapped statuses are
+// logged at Debug, the default for all, and WithSlowThreshold can only raise the level
+func WithStatusLevelMap(levels map[int]glog.Level) Option {
+	return func(cfg *config) {
+		cfg.statusLevels = levels
+	}
+}
+
+// WithEnrich set a func called on every entry, of New and of ErrorLoggerT panics, once all the
+// standard fields are set and before the message is built and the entry formatted. It may
+// change any field or add its own to param.Fields. It runs after body and query redaction,
+// so values it sets are logged as they are
+func WithEnrich(fn EnrichFn) Option {
+	return func(cfg *config) {
+		cfg.enrich = fn
+	}
+}
+
+// WithCaptureHeaders set whether LogFormatterParams.RequestHeaders and ResponseHeaders are
+// filled, for custom formatters and WriterLogFn. Headers follow the body capture gating of
+// WithDebugHeader and WithClientSampling; Authorization, Proxy-Authorization, Cookie and
+// Set-Cookie values are masked
+func WithCaptureHeaders(capture bool) Option {
+	return func(cfg *config) {
+		cfg.captureHeaders = capture
+	}
+}
+
+// defaultDownloadThreshold is the WithDownloadThreshold default.
+const defaultDownloadThreshold = 1 << 20
+
+// WithDownloadThreshold set the size, in bytes, past which a response stops being buffered and
+// is logged as "<file download: name, size>", as are attachments. It keeps large c.File and
+// streamed downloads from being held in memory. Default 1 MiB, 0 disables the threshold
+func WithDownloadThreshold(bytes int64) Option {
+	return func(cfg *config) {
+		cfg.downloadThreshold = bytes
+	}
+}
+
+// WithMaxRequestBodyRead set the number of request body bytes buffered for logging. The rest of
+// a longer body is not buffered but still streamed to the handler, and RequestData is marked
+// as cut, so large uploads keep their memory footprint. With WithRedactKeys a cut body is not
+// logged at all, since it cannot be redacted. Default 0, the whole body is read
+func WithMaxRequestBodyRead(limit int64) Option {
+	return func(cfg *config) {
+		cfg.maxRequestBodyRead = limit
+	}
+}
+
+// WithCoalesce set the window within which consecutive requests with the same method, route and
+// status, such as health checks, are logged as one entry carrying their Count. Entries are
+// delayed until the run ends, use NewCoalescer with WithCoalescer to Close it on shutdown
+func WithCoalesce(window time.Duration) Option {
+	return func(cfg *config) {
+		if window > 0 {
+			cfg.coalescer = NewCoalescer(window)
+		}
+	}
+}
+
+// WithCoalescer set the Coalescer merging identical consecutive requests, see WithCoalesce
+func WithCoalescer(coalescer *Coalescer) Option {
+	return func(cfg *config) {
+		cfg.coalescer = coalescer
+	}
+}
+
+// WithOutput set a writer receiving each formatted entry followed by a newline, for tests and
+// small tools not using glog. WithLogger takes precedence when both are set
+func WithOutput(w io.Writer) Option {
+	return func(cfg *config) {
+		cfg.output = w
+	}
+}
+
+// WithMetricsHook set a MetricsHook called once per logged request, before error rate limiting,
+// so metrics share the cardinality of the logging labels without this package importing a
+// metrics library
+func WithMetricsHook(fn MetricsHook) Option {
+	return func(cfg *config) {
+		cfg.metricsHook = fn
+	}
+}
+
+// WithCurlOnError set whether failed requests get a "curl" field, also logged as a separate
+// line, with a curl command reproducing them: method, URL, headers and the captured body.
+// Credential headers are masked and JSON bodies redacted with WithRedactKeys. Off by default,
+// the commands are verbose
+func WithCurlOnError(enable bool) Option {
+	return func(cfg *config) {
+		cfg.curlOnError = enable
+	}
+}
+
+// WithCurlMinStatus set the lowest status WithCurlOnError applies to, default 500
+func WithCurlMinStatus(status int) Option {
+	return func(cfg *config) {
+		cfg.curlMinStatus = status
+	}
+}
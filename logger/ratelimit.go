@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"sync"
+	"time"
+)
+
+// maxRateLimitKeys bounds the number of route+status keys tracked by errorLimiter.
+const maxRateLimitKeys = 4096
+
+type rateWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// errorLimiter allows at most perSecond log lines per key in fixed one second windows
+// and counts what it suppressed so a summary can be emitted with the next allowed line.
+type errorLimiter struct {
+	perSecond int
+	now       func() time.Time
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+}
+
+func newErrorLimiter(perSecond int) *errorLimiter {
+	return &errorLimiter{perSecond: perSecond, now: time.Now, windows: make(map[string]*rateWindow)}
+}
+
+// allow reports whether a line for key may be logged now, and how many lines for key
+// were suppressed since the last allowed one.
+func (l *errorLimiter) allow(key string, now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w, ok := l.windows[key]
+	if !ok {
+		if len(l.windows) >= maxRateLimitKeys {
+			l.evict(now)
+		}
+		if len(l.windows) >= maxRateLimitKeys {
+			// Too many distinct hot keys: log rather than grow without bound.
+			return true, 0
+		}
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+	if now.Sub(w.start) >= time.Second {
+		w.start = now
+		w.count = 0
+	}
+	if w.count >= l.perSecond {
+		w.suppressed++
+		return false, 0
+	}
+	w.count++
+	suppressed := w.suppressed
+	w.suppressed = 0
+	return true, suppressed
+}
+
+// evict drops the windows that expired and have nothing left to report.
+func (l *errorLimiter) evict(now time.Time) {
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= time.Second && w.suppressed == 0 {
+			delete(l.windows, key)
+		}
+	}
+}
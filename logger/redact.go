@@ -0,0 +1,112 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const redactedValue = "***"
+
+// defaultRedactQueryKeys are the query parameters masked in the logged Path by default.
+var defaultRedactQueryKeys = []string{"token", "access_token", "api_key"}
+
+func newKeySet(keys []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key == "" {
+			continue
+		}
+		set[key] = struct{}{}
+	}
+	return set
+}
+
+// sensitiveHeaders are masked by maskHeaders.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// maskHeaders returns a copy of header with the credential headers masked.
+func maskHeaders(header http.Header) http.Header {
+	out := header.Clone()
+	if out == nil {
+		out = http.Header{}
+	}
+	for _, key := range sensitiveHeaders {
+		if values, ok := out[key]; ok {
+			masked := make([]string, len(values))
+			for i := range masked {
+				masked[i] = redactedValue
+			}
+			out[key] = masked
+		}
+	}
+	return out
+}
+
+// redactQuery masks the values of the configured keys in a raw query string,
+// keeping the order and encoding of every other parameter untouched.
+func (c *config) redactQuery(raw string) string {
+	if raw == "" || len(c.redactQueryKeys) == 0 {
+		return raw
+	}
+	parts := strings.Split(raw, "&")
+	for i, part := range parts {
+		key, _, hasValue := strings.Cut(part, "=")
+		if name, err := url.QueryUnescape(key); err == nil {
+			key = name
+		}
+		if _, ok := c.redactQueryKeys[strings.ToLower(key)]; !ok {
+			continue
+		}
+		if hasValue {
+			parts[i] = part[:strings.IndexByte(part, '=')+1] + redactedValue
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// redactBody masks the values of the WithRedactKeys keys, at any depth, in a JSON body.
+// Other bodies, and JSON that fails to parse, are returned untouched.
+func (c *config) redactBody(contentType string, body []byte) []byte {
+	if len(c.redactKeys) == 0 || len(body) == 0 || !strings.Contains(strings.ToLower(contentType), "json") {
+		return body
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return body
+	}
+	if !c.redactValue(value) {
+		return body
+	}
+	redacted, err := json.Marshal(value)
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+// redactValue masks the matching keys of value in place and reports whether any was found.
+func (c *config) redactValue(value interface{}) bool {
+	found := false
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if _, ok := c.redactKeys[strings.ToLower(key)]; ok {
+				v[key] = redactedValue
+				found = true
+				continue
+			}
+			found = c.redactValue(field) || found
+		}
+	case []interface{}:
+		for _, item := range v {
+			found = c.redactValue(item) || found
+		}
+	}
+	return found
+}
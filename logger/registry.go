@@ -0,0 +1,38 @@
+package logger
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	formattersMu sync.RWMutex
+	formatters   = map[string]LogFormatter{
+		"default": defaultLogFormatter,
+		"fast":    FastTextFormatter,
+		"ecs":     ECSFormatter,
+		"json":    JSONFormatter,
+	}
+)
+
+// RegisterFormatter makes a formatter available to WithFormatterName under name,
+// replacing any formatter previously registered with that name.
+func RegisterFormatter(name string, f LogFormatter) {
+	if f == nil {
+		panic("logger: RegisterFormatter formatter is nil")
+	}
+	formattersMu.Lock()
+	defer formattersMu.Unlock()
+	formatters[name] = f
+}
+
+// LookupFormatter returns the formatter registered under name.
+func LookupFormatter(name string) (LogFormatter, error) {
+	formattersMu.RLock()
+	defer formattersMu.RUnlock()
+	f, ok := formatters[name]
+	if !ok {
+		return nil, fmt.Errorf("logger: unknown formatter %q", name)
+	}
+	return f, nil
+}
@@ -0,0 +1,45 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// readCloser reads from Reader and closes the original request body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// readRequestBody buffers the request body for logging, at most limit bytes when limit is
+// positive, and puts a body streaming the buffered bytes then the unread rest back on r.
+// cut reports whether the body was longer than limit.
+func readRequestBody(r *http.Request, limit int64) (data []byte, cut bool) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, false
+	}
+	body := r.Body
+	reader := io.Reader(body)
+	if limit > 0 {
+		reader = io.LimitReader(body, limit+1)
+	}
+	data, err := io.ReadAll(reader)
+	r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(data), body), Closer: body}
+	if err != nil {
+		return nil, false
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		return data[:limit], true
+	}
+	return data, false
+}
+
+// cutRequestData marks RequestData as the beginning of a body longer than limit.
+func cutRequestData(data string, limit int64) string {
+	if data == "" {
+		return ""
+	}
+	return fmt.Sprintf("request body exceeds read limit, limit size: %d \n%s", limit, data)
+}